@@ -5,10 +5,12 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"time"
 
 	"github.com/therekrab/blur/cfg"
 	"github.com/therekrab/blur/client"
 	"github.com/therekrab/blur/errorhandling"
+	"github.com/therekrab/blur/secure"
 	"github.com/therekrab/blur/server"
 	"github.com/therekrab/blur/ui"
 )
@@ -37,6 +39,28 @@ func main() {
     addr := flag.String("addr", userCfg.Client.Addr,
         "(client mode) The remote address to connect to.",
     )
+    kxFlag := flag.String("kx", userCfg.Client.KeyExchange,
+        "(client mode) Key exchange for a new session " +
+            "(passphrase, x25519, x25519-mlkem768)",
+    )
+    cipherFlag := flag.String("cipher", userCfg.Client.Cipher,
+        "(client mode) Cipher suite for a new session",
+    )
+    tlsFlag := flag.Bool("tls", userCfg.Client.TLS,
+        "(client mode) Connect over TLS",
+    )
+    pinFlag := flag.String("pin", userCfg.Client.TLSPin,
+        "(client mode) Expected TLS certificate fingerprint (implies -tls)",
+    )
+    proxyFlag := flag.String("proxy", userCfg.Client.Proxy,
+        "(client mode) Connect through this proxy (socks5:// or http://)",
+    )
+    ttlFlag := flag.String("ttl", userCfg.Client.TTL,
+        "(client mode) Keep a new session open this long after everybody leaves",
+    )
+    weakFlag := flag.Bool("weak", false,
+        "(client mode) Allow a new session with a weak session key",
+    )
     oldUsage := flag.CommandLine.Usage
     flag.CommandLine.Usage = func() {
         oldUsage()
@@ -47,6 +71,20 @@ func main() {
     }
     // Parse the flags
     flag.Parse()
+    userCfg.Client.TLS = *tlsFlag || *pinFlag != ""
+    userCfg.Client.TLSPin = *pinFlag
+    userCfg.Client.Proxy = *proxyFlag
+    userCfg.Client.TTL = *ttlFlag
+    kx, err := secure.ParseKeyExchange(*kxFlag)
+    if err != nil {
+        errorhandling.Report(err, true)
+        errorhandling.Exit()
+    }
+    suite, err := secure.ParseSuite(*cipherFlag)
+    if err != nil {
+        errorhandling.Report(err, true)
+        errorhandling.Exit()
+    }
     // Start the UI
     // Determine functionality
     if *serverFlag {
@@ -54,9 +92,15 @@ func main() {
             ui.Quiet()
         }
         ui.SetLog(userCfg.Server.Log)
-        server.RunServer(userCfg.Server.Port)
+        server.RunServer(userCfg.Server)
     } else {
         // Setup UI
+        err = ui.SetPanicKey(userCfg.Client.Panic)
+        if err != nil {
+            errorhandling.Report(err, true)
+            errorhandling.Exit()
+        }
+        ui.OnPanic(secure.WipeAll)
         ui.Init()
         done := make(chan error)
         go ui.Run(done)
@@ -75,7 +119,12 @@ func main() {
                 break
             }
         }
-        sessionKey, err := ui.ReadSecureInput("Session key: ")
+        var sessionKey string
+        if *newFlag {
+            sessionKey, err = readNewKey(userCfg.Client.MinEntropy, *weakFlag)
+        } else {
+            sessionKey, err = ui.ReadSecureInput("Session key: ")
+        }
         if err != nil {
             errorhandling.Exit()
         }
@@ -84,9 +133,9 @@ func main() {
             errorhandling.Exit()
         }
         if *newFlag {
-            doNew(*addr, sessionKey, ident)
+            doNew(*addr, sessionKey, ident, kx, suite, userCfg.Client)
         } else {
-            doJoin(*addr, sessionID, sessionKey, ident)
+            doJoin(*addr, sessionID, sessionKey, ident, userCfg.Client)
         }
         err = <- done
         if err != nil {
@@ -96,8 +145,20 @@ func main() {
     errorhandling.Exit()
 }
 
-func doNew(addr string, sessionKey string, ident string) {
-    cfg, err := client.NewSessionConfig(sessionKey, ident)
+func doNew(
+    addr string,
+    sessionKey string,
+    ident string,
+    kx secure.KeyExchange,
+    suite secure.Suite,
+    clientCfg cfg.ClientCfg,
+) {
+    cfg, err := client.NewSessionConfig(sessionKey, ident, kx, suite)
+    if err != nil {
+        errorhandling.Report(err, true)
+        return
+    }
+    err = configure(&cfg, clientCfg)
     if err != nil {
         errorhandling.Report(err, true)
         return
@@ -109,13 +170,24 @@ func doNew(addr string, sessionKey string, ident string) {
     }
 }
 
-func doJoin(addr string, sessionID uint16, sessionKey string, ident string) {
+func doJoin(
+    addr string,
+    sessionID uint16,
+    sessionKey string,
+    ident string,
+    clientCfg cfg.ClientCfg,
+) {
     ui.Out("Attempting to join session %x\n", sessionID)
     cfg, err := client.JoinSessionConfig(sessionID, sessionKey, ident)
     if err != nil {
         errorhandling.Report(err, true)
         return
     }
+    err = configure(&cfg, clientCfg)
+    if err != nil {
+        errorhandling.Report(err, true)
+        return
+    }
     c := client.NewClient(addr, cfg)
     err = c.Run(addr)
     if err != nil {
@@ -123,8 +195,115 @@ func doJoin(addr string, sessionID uint16, sessionKey string, ident string) {
     }
 }
 
+// Asks for the key of a new session, offering a generated one, and keeps
+// asking until the key is estimated at minEntropy bits or more (unless weak).
+func readNewKey(minEntropy uint, weak bool) (sessionKey string, err error) {
+    suggested, err := secure.GeneratePassphrase(secure.PassphraseWords)
+    if err != nil {
+        return
+    }
+    ui.Out(
+        "Suggested session key: %s (%.0f bits)\n",
+        suggested,
+        secure.Entropy(suggested),
+    )
+    ui.Out("Press enter to use it, or type your own.\n")
+    meter := func(text string) string {
+        bits := secure.Entropy(text)
+        return fmt.Sprintf("%.0f bits, %s", bits, secure.Strength(bits))
+    }
+    for {
+        sessionKey, err = ui.ReadSecureInputMeter("Session key: ", meter)
+        if err != nil {
+            return
+        }
+        if sessionKey == "" {
+            sessionKey = suggested
+            return
+        }
+        if err = checkKeyStrength(sessionKey, minEntropy, weak); err == nil {
+            return
+        }
+        errorhandling.Report(err, false)
+    }
+}
+
+// Turns down a key estimated below minEntropy bits, unless weak.
+func checkKeyStrength(sessionKey string, minEntropy uint, weak bool) (err error) {
+    bits := secure.Entropy(sessionKey)
+    if weak || bits >= float64(minEntropy) {
+        return
+    }
+    err = fmt.Errorf(
+        "session key is too weak (%.0f bits, want %d); " +
+            "use -weak to allow it anyway",
+        bits,
+        minEntropy,
+    )
+    return
+}
+
 func parseSessionID(sessionHex string) (sessionID uint16, err error) {
     sessionIDBig, err :=  strconv.ParseUint(sessionHex, 16, 16)
     sessionID = uint16(sessionIDBig)
     return
 }
+
+// Applies the [client] settings that new and joined sessions have in common.
+func configure(
+    clientConfig *client.ClientConfig,
+    clientCfg cfg.ClientCfg,
+) (err error) {
+    rekey := client.RekeyPolicy{
+        Messages: clientCfg.Rekey.Messages,
+        Roster: clientCfg.Rekey.Roster,
+    }
+    if clientCfg.Rekey.Interval != "" {
+        rekey.Interval, err = time.ParseDuration(clientCfg.Rekey.Interval)
+        if err != nil {
+            return
+        }
+    }
+    clientConfig.SetRekeyPolicy(rekey)
+    padding, err := secure.ParsePadding(clientCfg.Padding)
+    if err != nil {
+        return
+    }
+    clientConfig.SetPadding(padding)
+    clientConfig.SetStrict(clientCfg.Strict)
+    clientConfig.SetApproval(clientCfg.Approval)
+    clientConfig.SetTLS(clientCfg.TLS, clientCfg.TLSPin)
+    err = clientConfig.SetProxy(clientCfg.Proxy, clientCfg.ProxyStrict)
+    if err != nil {
+        return
+    }
+    err = clientConfig.SetHandles(clientCfg.Handles)
+    if err != nil {
+        return
+    }
+    if clientCfg.Cover != "" {
+        var cover time.Duration
+        cover, err = time.ParseDuration(clientCfg.Cover)
+        if err != nil {
+            return
+        }
+        clientConfig.SetCoverTraffic(cover)
+    }
+    if clientCfg.TTL != "" {
+        var ttl time.Duration
+        ttl, err = time.ParseDuration(clientCfg.TTL)
+        if err != nil {
+            return
+        }
+        clientConfig.SetSessionTTL(ttl)
+    }
+    if clientCfg.Lock != "" {
+        var lock time.Duration
+        lock, err = time.ParseDuration(clientCfg.Lock)
+        if err != nil {
+            return
+        }
+        clientConfig.SetLockTimeout(lock)
+    }
+    return
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/therekrab/blur/cfg"
+	"github.com/therekrab/blur/secure"
+)
+
+// The minentropy new sessions get unless the user changes it.
+func defaultMinEntropy(t *testing.T) uint {
+    t.Helper()
+    var defaults cfg.BlurCfg
+    if _, err := toml.DecodeFile("cfg/default/config.toml", &defaults); err != nil {
+        t.Fatal(err)
+    }
+    if defaults.Client.MinEntropy != 60 {
+        t.Fatalf("minentropy defaults to %d", defaults.Client.MinEntropy)
+    }
+    return defaults.Client.MinEntropy
+}
+
+func TestKeyStrengthGate(t *testing.T) {
+    minEntropy := defaultMinEntropy(t)
+    diceware := strings.Join([]string{
+        "abacus", "abdomen", "abdominal", "abide", "abiding", "ability",
+    }, "-")
+    if err := checkKeyStrength(diceware, minEntropy, false); err != nil {
+        t.Fatalf("six words: %s", err)
+    }
+    generated, err := secure.GeneratePassphrase(secure.PassphraseWords)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err = checkKeyStrength(generated, minEntropy, false); err != nil {
+        t.Fatalf("the suggested key: %s", err)
+    }
+    for _, weak := range []string{"password", "dragon", "abacus"} {
+        if err = checkKeyStrength(weak, minEntropy, false); err == nil {
+            t.Errorf("accepted '%s'", weak)
+        }
+        // -weak lets it through anyway.
+        if err = checkKeyStrength(weak, minEntropy, true); err != nil {
+            t.Errorf("-weak refused '%s': %s", weak, err)
+        }
+    }
+}
@@ -16,10 +16,49 @@ type ServerCfg struct {
     Port uint `toml:"port"`
     Quiet bool `toml:"quiet"`
     Log string `toml:"log"`
+    TLS bool `toml:"tls"`
+    Listen []string `toml:"listen"`
+    Unix UnixCfg `toml:"unix"`
+    Queue uint `toml:"queue"`
+    Overflow string `toml:"overflow"`
+    WriteTimeout string `toml:"writetimeout"`
+    MaxTTL string `toml:"maxttl"`
+    Store string `toml:"store"`
+    KnockTimeout string `toml:"knocktimeout"`
+    Duplicates string `toml:"duplicates"`
+}
+
+// Applies to every Unix socket the server listens on.
+type UnixCfg struct {
+    Mode string `toml:"mode"`
+    Owner string `toml:"owner"`
+    Group string `toml:"group"`
+}
+
+type RekeyCfg struct {
+    Messages uint `toml:"messages"`
+    Interval string `toml:"interval"`
+    Roster bool `toml:"roster"`
 }
 
 type ClientCfg struct {
     Addr string `toml:"addr"`
+    KeyExchange string `toml:"keyexchange"`
+    Cipher string `toml:"cipher"`
+    Padding string `toml:"padding"`
+    Cover string `toml:"cover"`
+    Strict bool `toml:"strict"`
+    Handles bool `toml:"handles"`
+    MinEntropy uint `toml:"minentropy"`
+    Lock string `toml:"lock"`
+    Panic string `toml:"panic"`
+    TLS bool `toml:"tls"`
+    TLSPin string `toml:"tlspin"`
+    Proxy string `toml:"proxy"`
+    ProxyStrict bool `toml:"proxystrict"`
+    TTL string `toml:"ttl"`
+    Approval bool `toml:"approval"`
+    Rekey RekeyCfg `toml:"rekey"`
 }
 
 type BlurCfg struct {
@@ -41,6 +80,11 @@ func LoadConfig() (cfg BlurCfg, err error) {
     if err != nil {
         return
     }
+    // Start from the defaults, so that settings missing from an older config
+    // file still get sensible values.
+    if _, err = toml.DecodeFS(defaultDir, "default/config.toml", &cfg); err != nil {
+        return
+    }
     path := fmt.Sprintf("%s/.config/blur/config.toml", homeDir)
     if _, err = toml.DecodeFile(path, &cfg); err != nil {
         return
@@ -0,0 +1,61 @@
+package cfg
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Server keys are trusted on first use, then pinned in this file, one
+// "<addr> <kind> <fingerprint>" per line.
+const pinFile string = "known_servers"
+
+func Path(name string) (path string, err error) {
+    homeDir, err := home()
+    if err != nil {
+        return
+    }
+    path = fmt.Sprintf("%s/.config/blur/%s", homeDir, name)
+    return
+}
+
+func LookupPin(addr string, kind string) (fingerprint string, found bool, err error) {
+    path, err := Path(pinFile)
+    if err != nil {
+        return
+    }
+    file, err := os.Open(path)
+    if os.IsNotExist(err) {
+        err = nil
+        return
+    }
+    if err != nil {
+        return
+    }
+    defer file.Close()
+    scanner := bufio.NewScanner(file)
+    for scanner.Scan() {
+        fields := strings.Fields(scanner.Text())
+        if len(fields) != 3 || fields[0] != addr || fields[1] != kind {
+            continue
+        }
+        return fields[2], true, nil
+    }
+    err = scanner.Err()
+    return
+}
+
+func SavePin(addr string, kind string, fingerprint string) (err error) {
+    path, err := Path(pinFile)
+    if err != nil {
+        return
+    }
+    file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+    if err != nil {
+        return
+    }
+    defer file.Close()
+    _, err = fmt.Fprintf(file, "%s %s %s\n", addr, kind, fingerprint)
+    return
+}
@@ -0,0 +1,54 @@
+package client
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"github.com/therekrab/blur/sender"
+	"github.com/therekrab/blur/ui"
+)
+
+// Handles "<seconds> <text>" from .burn.
+func (client *Client) sendBurn(args string) (err error) {
+    secondsText, text, found := strings.Cut(args, " ")
+    if !found || strings.TrimSpace(text) == "" {
+        err = fmt.Errorf("usage: .burn <seconds> <text>")
+        return
+    }
+    seconds, err := strconv.ParseUint(secondsText, 10, 16)
+    if err != nil || seconds == 0 {
+        err = fmt.Errorf(
+            "burn time must be between 1 and %d seconds",
+            math.MaxUint16,
+        )
+        return
+    }
+    if !client.hasKey() {
+        err = fmt.Errorf("no group key yet, message not sent")
+        return
+    }
+    body := binary.BigEndian.AppendUint16(nil, uint16(seconds))
+    body = append(body, text...)
+    encrypted, err := client.encrypt(envBurn, body)
+    if err != nil {
+        return
+    }
+    return sender.SendChatE(client.conn, encrypted)
+}
+
+func (client *Client) showBurn(source []byte, body []byte) (err error) {
+    if len(body) < 2 {
+        err = fmt.Errorf("burn message too short")
+        return
+    }
+    seconds := binary.BigEndian.Uint16(body[:2])
+    ui.OutBurn(
+        fmt.Sprintf("'%s' : ", client.nameOf(source)),
+        string(body[2:]),
+        time.Duration(seconds) * time.Second,
+    )
+    return
+}
@@ -1,12 +1,16 @@
 package client
 
 import (
-	"encoding/binary"
+	"bytes"
 	"fmt"
 	"net"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 	"github.com/therekrab/blur/errorhandling"
 	"github.com/therekrab/blur/message"
+	"github.com/therekrab/blur/secure"
 	"github.com/therekrab/blur/sender"
 	"github.com/therekrab/blur/ui"
 )
@@ -14,8 +18,42 @@ import (
 type Client struct {
     mu sync.Mutex
     conn net.Conn
+    addr string
     active bool
+    // Guards the key material in cfg, which the output loop may replace,
+    // along with everything below.
+    keyMu sync.Mutex
     cfg ClientConfig
+    // Public key -> ident of every other member, for rekeying.
+    members map[string][]byte
+    rekeyScheduled bool
+    rekeyEpoch uint32
+    // The key the server signs events with, and the last event we accepted.
+    serverKey []byte
+    eventSeq uint64
+    // Handle -> display name, for members hiding their name from the server,
+    // and the ident of everybody here, so none of those names can pass for
+    // somebody else.
+    names map[string][]byte
+    roster map[string]bool
+    announced bool
+    // When the user last typed something, whatever arrived while the
+    // session was locked, and how much of that didn't fit (see hold).
+    lastInput time.Time
+    locked bool
+    pending []message.Message
+    dropped int
+    // REKEYs that came before the key they replace.
+    heldRekeys []heldRekey
+    // Whether we made the group key ourselves on finding the session empty,
+    // and who we've handed it to since (see yields).
+    originated bool
+    handedTo map[string]bool
+    // Whether we asked for the key again while still holding one (see
+    // askAgain). Until an answer opens, ours stays.
+    asking bool
+    // Whether the server has announced us as an owner.
+    owner bool
 }
 
 func NewClient(addr string, cfg ClientConfig) (client Client) {
@@ -25,13 +63,18 @@ func NewClient(addr string, cfg ClientConfig) (client Client) {
 
 func (client *Client) Close() {
     client.mu.Lock()
-    defer client.mu.Unlock()
     if client.active == false {
         // we're already closed
+        client.mu.Unlock()
         return
     }
     client.conn.Close()
     client.active = false
+    client.mu.Unlock()
+    // Whoever holds keyMu may be waiting on mu, so never hold both.
+    client.keyMu.Lock()
+    defer client.keyMu.Unlock()
+    client.cfg.wipe()
 }
 
 func (client *Client) isActive() bool {
@@ -44,25 +87,90 @@ func (client *Client) runInputLoop() {
     defer client.Close()
     for client.isActive() {
         // get input from the user
-        line, err := ui.ReadInput(string(client.cfg.ident))
+        var (
+            line string
+            err error
+        )
+        if client.isLocked() {
+            line, err = ui.ReadSecureInput(lockPrompt)
+        } else {
+            line, err = ui.ReadInput(string(client.cfg.name))
+        }
         if err != nil {
             client.Close()
             errorhandling.Exit()
         }
+        if client.isLocked() {
+            // The session locked while we were waiting, so that was (meant to
+            // be) the passphrase.
+            client.unlock(line)
+            continue
+        }
+        client.touch()
         if line == ".exit" {
             // the client would like to leave
             client.Close()
             errorhandling.Exit()
         }
+        if line == ".rekey" {
+            err = client.Rekey()
+            if err != nil {
+                errorhandling.Report(err, false)
+            }
+            continue
+        }
+        if strings.HasPrefix(line, ".burn ") {
+            err = client.sendBurn(strings.TrimPrefix(line, ".burn "))
+            if err != nil {
+                errorhandling.Report(err, false)
+            }
+            continue
+        }
+        if line == ".nick" || strings.HasPrefix(line, ".nick ") {
+            err = client.nick(strings.TrimPrefix(line, ".nick"))
+            if err != nil {
+                errorhandling.Report(err, false)
+            }
+            continue
+        }
+        if handled, err := client.moderate(line); handled {
+            if err != nil {
+                errorhandling.Report(err, false)
+            }
+            continue
+        }
+        if line == ".who" {
+            err = sender.SendIdentR(client.conn)
+            if err != nil {
+                errorhandling.Report(err, false)
+            }
+            continue
+        }
         if line == ".help" {
             ui.Out("==== HELP (Your eyes only) ====\n")
             ui.Out("\tType .help to see this message again.\n")
+            ui.Out("\tType .who to see who is in the session.\n")
+            ui.Out("\tType .rekey to rotate the group key.\n")
+            ui.Out("\tType .burn <seconds> <text> for a message that burns.\n")
+            ui.Out("\tType .nick <name> to change your name.\n")
+            ui.Out("\tType .claim <secret> to become an owner again.\n")
+            ui.Out("\tOwners can type .kick <name>, .ban <name>, and .lock or\n")
+            ui.Out("\t.unlock to stop or allow new members joining.\n")
+            ui.Out("\tOwners can type .approval on/off to make new members\n")
+            ui.Out("\twait, and .admit <name> or .deny <name> to decide.\n")
+            ui.Out("\tOwners can type .promote <name> to share ownership, and\n")
+            ui.Out("\t.demote <name> to take it back.\n")
             ui.Out("\tType .exit to leave the chat.\n")
             ui.Out("\t<Esc> will also quit.\n")
             continue // noo dont send that
         }
         // Build and send the chat
-        encryptedData, err := client.cfg.encrypt(line)
+        if !client.hasKey() {
+            err = fmt.Errorf("no group key yet, message not sent")
+            errorhandling.Report(err, false)
+            continue
+        }
+        encryptedData, err := client.encrypt(envText, []byte(line))
         if err != nil {
             errorhandling.Report(err, true)
             return
@@ -71,6 +179,29 @@ func (client *Client) runInputLoop() {
     }
 }
 
+func (client *Client) hasKey() bool {
+    client.keyMu.Lock()
+    defer client.keyMu.Unlock()
+    return client.cfg.hasKey()
+}
+
+func (client *Client) encrypt(
+    kind envelopeKind,
+    body []byte,
+) (encrypted []byte, err error) {
+    client.keyMu.Lock()
+    defer client.keyMu.Unlock()
+    return client.cfg.encrypt(kind, body)
+}
+
+func (client *Client) decrypt(
+    encrypted []byte,
+) (kind envelopeKind, sender []byte, body []byte, err error) {
+    client.keyMu.Lock()
+    defer client.keyMu.Unlock()
+    return client.cfg.decrypt(encrypted)
+}
+
 func (client *Client) identRoutine() (err error) {
     ident := client.cfg.ident
     idents := make([][]byte, 1)
@@ -79,32 +210,61 @@ func (client *Client) identRoutine() (err error) {
     if err != nil {
         return
     }
-    // Now request identification!
+    // Now request identification! The answer comes back through the output
+    // loop, like any other message.
     err = sender.SendIdentR(client.conn)
     if err != nil {
         return
     }
-    response, err := message.ReadMessage(client.conn)
+    err = client.requestKey()
     if err != nil {
         return
     }
-    if response.MType() != message.IDENT {
-        err = fmt.Errorf(
-            "invalid response to IDENTR received: %v",
-            response.MType(),
-        )
-        return
+    if client.cfg.ownerSecret != nil {
+        err = sender.SendOwn(client.conn, client.cfg.ownerSecret.Bytes())
+        if err != nil {
+            return
+        }
     }
-    reponseIdents, err := message.ParseIdent(response.Data())
+    if client.cfg.approval && !client.cfg.join {
+        err = sender.SendMod(client.conn, message.ModApprovalOn, nil)
+        if err != nil {
+            return
+        }
+    }
+    client.keyMu.Lock()
+    defer client.keyMu.Unlock()
+    if client.cfg.hasKey() {
+        err = client.announceName(true)
+    }
+    return
+}
+
+func (client *Client) showRoster(data []byte) (err error) {
+    reponseIdents, owners, err := message.ParseRoster(data)
     if err != nil {
         return
     }
-    
+    client.keyMu.Lock()
+    defer client.keyMu.Unlock()
+    client.roster = nil
     ui.OutBold("=== ACTIVE USERS: ===\n")
     for _, reponseIdent := range reponseIdents {
-        ui.Out("\t'%s'\n", reponseIdent)
+        client.seen(reponseIdent, true)
+        if slices.ContainsFunc(owners, func(owner []byte) bool {
+            return bytes.Equal(owner, reponseIdent)
+        }) {
+            ui.Out("\t'%s' (owner)\n", client.displayName(reponseIdent))
+            continue
+        }
+        ui.Out("\t'%s'\n", client.displayName(reponseIdent))
     }
     ui.OutBold("===== END USERS =====\n")
+    alone := len(reponseIdents) == 1 &&
+        bytes.Equal(reponseIdents[0], client.cfg.ident)
+    if alone && client.cfg.kx != secure.Passphrase && !client.cfg.hasKey() {
+        err = client.startAlone()
+    }
     return
 }
 
@@ -121,70 +281,184 @@ func (client *Client) runOutputLoop() (err error) {
             errorhandling.Report(err, true)
             return
         }
-        switch msg.MType() {
-        case message.IDENTR:
-            err = client.identRoutine()
-            if err != nil {
-                errorhandling.Report(err, true)
-                return
-            }
+        if client.hold(msg) {
             continue
-        case message.CHT:
-            var (
-                source []byte
-                cht []byte
-            )
-            source, cht, err = message.ParseCht(msg.Data())
-            if err != nil {
-                errorhandling.Report(err, true)
-                return
+        }
+        err = client.handleMessage(msg)
+        if err != nil {
+            errorhandling.Report(err, true)
+            return
+        }
+    }
+    return
+}
+
+// Anything that goes wrong in here and isn't reported right away is fatal.
+func (client *Client) handleMessage(msg message.Message) (err error) {
+    switch msg.MType() {
+    case message.IDENTR:
+        return client.identRoutine()
+    case message.IDENT:
+        err = client.showRoster(msg.Data())
+        if err != nil {
+            errorhandling.Report(err, false)
+        }
+        return nil
+    case message.KEYR:
+        err = client.handleKeyR(msg.Data())
+        if err != nil {
+            errorhandling.Report(err, false)
+        }
+        return nil
+    case message.KEY:
+        err = client.handleKey(msg.Data())
+        if err != nil {
+            errorhandling.Report(err, false)
+        }
+        return nil
+    case message.REKEY:
+        err = client.handleRekey(msg.Data())
+        if err != nil {
+            errorhandling.Report(err, false)
+        }
+        return nil
+    case message.EVT:
+        err = client.handleEvent(msg.Data())
+        if err != nil {
+            errorhandling.Report(err, false)
+        }
+        return nil
+    case message.ERR:
+        showRefusal(msg.Data())
+        return nil
+    case message.NAME:
+        client.takeIdent(msg.Data())
+        return nil
+    case message.CHT:
+        source, cht, err := message.ParseCht(msg.Data())
+        if err != nil {
+            return err
+        }
+        if client.cfg.strict {
+            // Members only ever send CHTE, so this came from the server
+            // (or somebody pretending to be it).
+            ui.OutWarn("[untrusted server notice] '%s' : %s\n", source, cht)
+            return nil
+        }
+        ui.Out("'%s' : %s\n", source, cht)
+        return nil
+    case message.SRVKEY:
+        return client.handleServerKey(msg.Data())
+    case message.CHTE:
+        source, chte, err := message.ParseCht(msg.Data())
+        if err != nil {
+            return err
+        }
+        if !client.hasKey() {
+            // Nothing we can do with it yet.
+            return nil
+        }
+        kind, sender, cht, err := client.decrypt(chte)
+        if err != nil {
+            // One frame we can't read isn't worth leaving over, least of all
+            // when we just missed a rekey.
+            errorhandling.Report(err, false)
+            if err = client.catchUp(source, chte); err != nil {
+                errorhandling.Report(err, false)
             }
-            ui.Out("'%s' : %s\n", source, cht)
-            continue
-        case message.CHTE:
-            var (
-                source []byte
-                chte []byte
+            return nil
+        }
+        if kind == envCover {
+            return nil
+        }
+        client.countFrame(chte)
+        // Who sent it is whoever sealed it. The server's label only matters
+        // when it doesn't agree.
+        if err = message.ValidateIdent(sender); err != nil {
+            errorhandling.Report(
+                fmt.Errorf("dropped a message from '%s': %w", source, err),
+                false,
+            )
+            return nil
+        }
+        if !bytes.Equal(sender, source) {
+            ui.OutWarn(
+                "The server says '%s' sent the next message, but it was sealed by '%s'\n",
+                source,
+                sender,
             )
-            source, chte, err = message.ParseCht(msg.Data())
+        }
+        switch kind {
+        case envText:
+            ui.Out("'%s' : %s\n", client.nameOf(sender), string(cht))
+        case envBurn:
+            err = client.showBurn(sender, cht)
             if err != nil {
-                errorhandling.Report(err, true)
-                return
+                errorhandling.Report(err, false)
             }
-            var cht []byte
-            cht, err = client.cfg.decrypt(chte)
+        case envName:
+            err = client.handleName(sender, cht)
             if err != nil {
-                errorhandling.Report(err, true)
-                return
+                errorhandling.Report(err, false)
             }
-            ui.Out("'%s' : %s\n", source, string(cht))
-            continue
         }
-        // invalid type received
-        err = fmt.Errorf("invalid type received: %d", msg.MType())
-        errorhandling.Report(err, true)
+        // Anything else is silently dropped.
+        return nil
     }
-    return
+    // invalid type received
+    return fmt.Errorf("invalid type received: %d", msg.MType())
 }
 
 func (client *Client) runLoop() {
     go client.runOutputLoop()
+    go client.runRekeyLoop()
+    go client.runCoverLoop()
+    go client.runLockLoop()
     client.runInputLoop()
 }
 
+func (client *Client) askSalt() (err error) {
+    if err = sender.SendSaltR(client.conn, client.cfg.sessionID); err != nil {
+        return
+    }
+    response, err := message.ReadMessage(client.conn)
+    if err != nil {
+        return
+    }
+    switch response.MType() {
+    case message.SALT:
+        // The salt is checked where it's used.
+        return client.cfg.deriveKeys(response.Data())
+    case message.REJ:
+        return rejection(response.Data())
+    }
+    return fmt.Errorf(
+        "invalid response received from server (%d)",
+        response.MType(),
+    )
+}
+
 func (client *Client) Run(addr string) (err error) {
-    client.conn, err = net.Dial("tcp", addr)
+    client.addr = addr
+    client.conn, err = client.dial()
     if err != nil {
         errorhandling.Report(err, true)
         return
     }
     client.active = true
+    ui.OnPanic(client.Close)
     if client.cfg.join {
+        // The key hash depends on the session's salt, so ask for that first
+        if err = client.askSalt(); err != nil {
+            errorhandling.Report(err, true)
+            return
+        }
         // send a JOINR request
         err = sender.SendJoinR(
             client.conn,
             client.cfg.sessionID,
             client.cfg.HashedKey(),
+            client.cfg.ident,
         )
         if err != nil {
             errorhandling.Report(err, true)
@@ -196,17 +470,27 @@ func (client *Client) Run(addr string) (err error) {
             errorhandling.Report(err, true)
             return
         }
+        if response.MType() == message.WAIT {
+            ui.Out("Waiting for an owner to let you in...\n")
+            response, err = message.ReadMessage(client.conn)
+            if err != nil {
+                errorhandling.Report(err, true)
+                return
+            }
+        }
         switch response.MType() {
         case message.ACC:
+            err = client.cfg.applyParams(response.Data())
+            if err != nil {
+                errorhandling.Report(err, true)
+                return
+            }
             ui.Out("Joined session %x\n", client.cfg.sessionID)
+            ui.Out("Cipher suite: %s\n", client.cfg.ring.suite)
             client.runLoop()
             return
         case message.REJ:
-            if response.Data()[0] == 0 {
-                err = fmt.Errorf("invalid sessionID")
-            } else {
-                err = fmt.Errorf("incrorect credentials")
-            }
+            err = rejection(response.Data())
             errorhandling.Report(err, true)
             return
         }
@@ -216,7 +500,13 @@ func (client *Client) Run(addr string) (err error) {
         )
         errorhandling.Report(err, true)
     } else {
-        err = sender.SendNewR(client.conn, client.cfg.HashedKey())
+        err = sender.SendNewR(
+            client.conn,
+            client.cfg.HashedKey(),
+            client.cfg.salt,
+            client.cfg.ttl,
+            client.cfg.params(),
+        )
         if err != nil {
             errorhandling.Report(err, true)
             return
@@ -228,8 +518,34 @@ func (client *Client) Run(addr string) (err error) {
             return
         }
         if response.MType() == message.NEW {
-            client.cfg.sessionID = binary.BigEndian.Uint16(response.Data())
+            var ttl time.Duration
+            var ownerSecret []byte
+            client.cfg.sessionID, ttl, ownerSecret, err = message.ParseNewResponse(
+                response.Data(),
+            )
+            if err != nil {
+                errorhandling.Report(err, true)
+                return
+            }
             ui.Out("Created session %x\n", client.cfg.sessionID)
+            if ownerSecret != nil {
+                ui.Out(
+                    "Owner secret: %x (.claim it to moderate after rejoining)\n",
+                    ownerSecret,
+                )
+                client.cfg.SetOwnerSecret(ownerSecret)
+            }
+            if ttl > 0 {
+                ui.Out("It stays open for %s after everybody leaves\n", ttl)
+            }
+            if ttl < client.cfg.ttl {
+                ui.OutWarn(
+                    "The server only keeps empty sessions for %s\n",
+                    ttl,
+                )
+            }
+            ui.Out("Key exchange: %s\n", client.cfg.kx)
+            ui.Out("Cipher suite: %s\n", client.cfg.ring.suite)
             client.runLoop()
         } else {
             err = fmt.Errorf("Failed creating new session")
@@ -1,29 +1,277 @@
 package client
 
 import (
-	"crypto/cipher"
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+	"github.com/therekrab/blur/message"
 	"github.com/therekrab/blur/secure"
+	"golang.org/x/net/proxy"
 )
 
 type ClientConfig struct {
     sessionID uint16
+    // What the server knows us by. Usually the same as name, unless we're
+    // hiding behind a handle.
     ident []byte
-    key []byte
+    name []byte
+    handles bool
+    // Both derived from the passphrase and the session's salt. The verifier
+    // is what the server checks, and the auth key is what proves we know the
+    // passphrase to other members (with key exchange, that's all it's used
+    // for). A joiner holds on to the passphrase until it's told the salt.
+    sessionKey *secure.Secret
+    salt []byte
+    authKey *secure.Secret
+    verifier []byte
+    // The keys messages are actually encrypted with. A joiner using key
+    // exchange has none of these until a member hands them over.
+    ring keyring
     join bool
-    aesGCM cipher.AEAD
+    kx secure.KeyExchange
+    keyPair secure.KeyPair
+    rekey RekeyPolicy
+    padding secure.Padding
+    // Mean time between cover messages (0 = none).
+    cover time.Duration
+    // Only show what members encrypted and what the server signed.
+    strict bool
+    // Lock the session after this long without input (0 = never).
+    lockTimeout time.Duration
+    // While locked, every key we hold, sealed under the passphrase key.
+    sealedKeys []byte
+    // Connect over TLS, expecting this certificate fingerprint (or whatever
+    // is pinned for the server, if empty).
+    tls bool
+    tlsPin string
+    // Where to connect through, if anywhere, and whether to give up (rather
+    // than go direct) when that doesn't work.
+    proxy proxy.Dialer
+    proxyStrict bool
+    // How long a new session should outlive its last member (0 = not at all).
+    ttl time.Duration
+    // Proves to the server that we own the session, if we do.
+    ownerSecret *secure.Secret
+    // Make new members of a new session wait for an owner to let them in.
+    approval bool
+}
+
+// When to replace the group key on our own. Only sessions using key exchange
+// can be rekeyed.
+type RekeyPolicy struct {
+    // Rekey after this many messages in one epoch (0 = never).
+    Messages uint
+    // Rekey once an epoch is this old (0 = never).
+    Interval time.Duration
+    // Rekey whenever somebody joins or leaves.
+    Roster bool
 }
 
 func (cc *ClientConfig) HashedKey() []byte {
-    hk := secure.Hash(cc.key)
-    return hk
+    return cc.verifier
+}
+
+// Works out the auth key and verifier, once the salt is known, and forgets
+// the passphrase.
+func (cc *ClientConfig) deriveKeys(salt []byte) (err error) {
+    authKey, verifier, err := secure.DeriveSessionKeys(
+        cc.sessionKey.Bytes(),
+        salt,
+    )
+    if err != nil {
+        return
+    }
+    cc.salt = bytes.Clone(salt)
+    cc.authKey = secure.NewSecret(authKey)
+    cc.verifier = verifier
+    cc.sessionKey.Wipe()
+    cc.sessionKey = nil
+    return
+}
+
+func (cc *ClientConfig) SetRekeyPolicy(policy RekeyPolicy) {
+    cc.rekey = policy
+}
+
+func (cc *ClientConfig) SetPadding(padding secure.Padding) {
+    cc.padding = padding
+}
+
+func (cc *ClientConfig) SetCoverTraffic(interval time.Duration) {
+    cc.cover = interval
+}
+
+func (cc *ClientConfig) SetStrict(strict bool) {
+    cc.strict = strict
+}
+
+func (cc *ClientConfig) SetSessionTTL(ttl time.Duration) {
+    cc.ttl = ttl
+}
+
+func (cc *ClientConfig) SetApproval(approval bool) {
+    cc.approval = approval
+}
+
+func (cc *ClientConfig) SetOwnerSecret(ownerSecret []byte) {
+    cc.ownerSecret.Wipe()
+    cc.ownerSecret = secure.NewSecret(bytes.Clone(ownerSecret))
+}
+
+func (cc *ClientConfig) SetTLS(enabled bool, pin string) {
+    cc.tls = enabled
+    cc.tlsPin = strings.ToLower(pin)
+}
+
+func (cc *ClientConfig) SetProxy(spec string, strict bool) (err error) {
+    cc.proxyStrict = strict
+    cc.proxy = nil
+    if spec == "" {
+        return
+    }
+    cc.proxy, err = parseProxy(spec)
+    return
+}
+
+func (cc *ClientConfig) SetLockTimeout(timeout time.Duration) {
+    cc.lockTimeout = timeout
+}
+
+// With handles, the server only ever learns a random handle, and our real name
+// only goes to the other members, encrypted.
+// With handles, the server never sees our name, so it can't check it either.
+func (cc *ClientConfig) SetHandles(handles bool) (err error) {
+    cc.handles = handles
+    cc.ident = cc.name
+    if handles {
+        if err = message.ValidateIdent(cc.name); err != nil {
+            return
+        }
+        cc.ident, err = newHandle()
+    }
+    return
+}
+
+func (cc *ClientConfig) encrypt(
+    kind envelopeKind,
+    body []byte,
+) (encrypted []byte, err error) {
+    return cc.ring.encrypt(sealEnvelope(kind, cc.ident, body), cc.padding)
+}
+
+func (cc *ClientConfig) decrypt(
+    encrypted []byte,
+) (kind envelopeKind, sender []byte, body []byte, err error) {
+    data, err := cc.ring.decrypt(encrypted)
+    if err != nil {
+        return
+    }
+    return openEnvelope(data)
+}
+
+func (cc *ClientConfig) hasKey() bool {
+    return cc.ring.ready()
 }
 
-func (cc *ClientConfig) encrypt(msg string) (encrypted []byte, err error) {
-    return secure.EncryptData(cc.aesGCM, []byte(msg))
+func (cc *ClientConfig) isLocked() bool {
+    return cc.sealedKeys != nil
 }
 
-func (cc *ClientConfig) decrypt(encrypted []byte) (msg []byte, err error) {
-    return secure.DecryptData(cc.aesGCM, encrypted)
+// Seals every key we hold under the passphrase key, and wipes them. Only the
+// passphrase gets them back. Our key pair is wiped too, and replaced on
+// unlock.
+func (cc *ClientConfig) lock() (err error) {
+    aead, err := cc.ring.suite.NewAEAD(cc.authKey.Bytes())
+    if err != nil {
+        return
+    }
+    keys := cc.ring.export()
+    defer keys.Wipe()
+    cc.sealedKeys, err = secure.EncryptData(aead, keys.Bytes(), secure.NoPadding)
+    if err != nil {
+        return
+    }
+    cc.ring.wipe()
+    cc.authKey.Wipe()
+    cc.authKey = nil
+    cc.keyPair.Wipe()
+    return
+}
+
+// The passphrase is right exactly when it opens the sealed keys. The key pair
+// isn't sealed with them, but replaced: members have to be told about the new
+// one (see Client.unlock).
+func (cc *ClientConfig) unlock(sessionKey string) (err error) {
+    key, _, err := secure.DeriveSessionKeys([]byte(sessionKey), cc.salt)
+    if err != nil {
+        return
+    }
+    authKey := secure.NewSecret(key)
+    aead, err := cc.ring.suite.NewAEAD(authKey.Bytes())
+    if err != nil {
+        authKey.Wipe()
+        return
+    }
+    keys, err := secure.DecryptData(aead, cc.sealedKeys)
+    if err != nil {
+        authKey.Wipe()
+        err = fmt.Errorf("wrong session key")
+        return
+    }
+    cc.authKey = authKey
+    cc.sealedKeys = nil
+    if err = cc.ring.restore(keys); err != nil {
+        return
+    }
+    if cc.kx != secure.Passphrase {
+        cc.keyPair, err = secure.GenKeyPair(cc.kx)
+    }
+    return
+}
+
+// Zeroes every key we hold, for when we're leaving.
+func (cc *ClientConfig) wipe() {
+    cc.ring.wipe()
+    cc.sessionKey.Wipe()
+    cc.sessionKey = nil
+    cc.authKey.Wipe()
+    cc.authKey = nil
+    cc.ownerSecret.Wipe()
+    cc.ownerSecret = nil
+    cc.keyPair.Wipe()
+    cc.sealedKeys = nil
+}
+
+// Session parameters are stored by the server as-is and handed to every
+// joiner in ACC, so everybody agrees on how the session works.
+func (cc *ClientConfig) params() []byte {
+    return []byte{byte(cc.kx), byte(cc.ring.suite)}
+}
+
+func (cc *ClientConfig) applyParams(params []byte) (err error) {
+    cc.kx = secure.Passphrase
+    if len(params) > 0 {
+        cc.kx = secure.KeyExchange(params[0])
+    }
+    cc.ring.suite = secure.AES256GCM
+    if len(params) > 1 {
+        cc.ring.suite = secure.Suite(params[1])
+    }
+    if !cc.ring.suite.Supported() {
+        err = fmt.Errorf("session uses an unsupported cipher suite")
+        return
+    }
+    switch cc.kx {
+    case secure.Passphrase:
+        err = cc.ring.install(0, bytes.Clone(cc.authKey.Bytes()))
+    case secure.X25519, secure.X25519MLKEM768:
+        // Wait to be handed the group key.
+        cc.keyPair, err = secure.GenKeyPair(cc.kx)
+    default:
+        err = fmt.Errorf("session uses an unsupported key exchange")
+    }
+    return
 }
 
 func JoinSessionConfig(
@@ -31,18 +279,12 @@ func JoinSessionConfig(
     sessionKey string,
     ident string,
 ) (client ClientConfig, err error) {
-    newKey := secure.GenKey(sessionKey)
-    var aesGCM cipher.AEAD
-    aesGCM, err = secure.BuildAesGCM(newKey)
-    if err != nil {
-        return
-    }
     client = ClientConfig {
-        sessionID,
-        []byte(ident),
-        newKey,
-        true,
-        aesGCM,
+        sessionID: sessionID,
+        ident: []byte(ident),
+        name: []byte(ident),
+        sessionKey: secure.NewSecret([]byte(sessionKey)),
+        join: true,
     }
     return
 }
@@ -50,19 +292,37 @@ func JoinSessionConfig(
 func NewSessionConfig(
     sessionKey string,
     ident string,
+    kx secure.KeyExchange,
+    suite secure.Suite,
 ) (client ClientConfig, err error) {
-    newKey := secure.GenKey(sessionKey)
-    var aesGCM cipher.AEAD
-    aesGCM, err = secure.BuildAesGCM(newKey)
+    client = ClientConfig {
+        sessionID: 0, // This will be set later.
+        ident: []byte(ident),
+        name: []byte(ident),
+        sessionKey: secure.NewSecret([]byte(sessionKey)),
+        join: false,
+        kx: kx,
+    }
+    client.ring.suite = suite
+    // We pick the salt, and hand it to the server for joiners.
+    salt, err := secure.NewSalt()
     if err != nil {
         return
     }
-    client = ClientConfig {
-        0, // This will be set later.
-        []byte(ident),
-        newKey,
-        false,
-        aesGCM,
+    if err = client.deriveKeys(salt); err != nil {
+        return
+    }
+    key := bytes.Clone(client.authKey.Bytes())
+    if kx != secure.Passphrase {
+        client.keyPair, err = secure.GenKeyPair(kx)
+        if err != nil {
+            return
+        }
+        key, err = secure.NewGroupKey()
+        if err != nil {
+            return
+        }
     }
+    err = client.ring.install(0, key)
     return
 }
@@ -0,0 +1,38 @@
+package client
+
+import (
+	"crypto/rand"
+	mathrand "math/rand/v2"
+	"time"
+	"github.com/therekrab/blur/errorhandling"
+	"github.com/therekrab/blur/sender"
+)
+
+// Cover messages carry up to this much junk, roughly the size of a short chat
+// line. Padding takes care of the rest.
+const maxCoverSize = 64
+
+// Sends encrypted junk at random (exponentially distributed) intervals, so
+// that an observer can't tell when we're actually talking. Receivers drop it
+// after decrypting.
+func (client *Client) runCoverLoop() {
+    mean := client.cfg.cover
+    if mean == 0 {
+        return
+    }
+    for client.isActive() {
+        wait := time.Duration(mathrand.ExpFloat64() * float64(mean))
+        time.Sleep(wait)
+        if !client.isActive() || !client.hasKey() {
+            continue
+        }
+        junk := make([]byte, mathrand.IntN(maxCoverSize + 1))
+        rand.Read(junk)
+        encrypted, err := client.encrypt(envCover, junk)
+        if err != nil {
+            errorhandling.Report(err, false)
+            continue
+        }
+        sender.SendChatE(client.conn, encrypted)
+    }
+}
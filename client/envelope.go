@@ -0,0 +1,44 @@
+package client
+
+import (
+	"fmt"
+)
+
+// The first byte of every decrypted CHTE says what it holds. The server can't
+// see it, so it can't tell cover traffic from real messages either. Then comes
+// the sender's ident (1 byte of length first), since the one the server puts
+// in front is only its word.
+type envelopeKind byte
+
+const (
+    envText envelopeKind = iota
+    // Cover traffic, dropped on arrival.
+    envCover
+    // The sender's real name, for members that only give the server a handle.
+    // The first byte is 1 if the sender would like everybody to reply with
+    // theirs.
+    envName
+    // Text that should only be on screen for a while. The first two bytes are
+    // how many seconds.
+    envBurn
+)
+
+func sealEnvelope(kind envelopeKind, sender []byte, body []byte) []byte {
+    data := make([]byte, 0, 2 + len(sender) + len(body))
+    data = append(data, byte(kind), byte(len(sender)))
+    data = append(data, sender...)
+    return append(data, body...)
+}
+
+func openEnvelope(
+    data []byte,
+) (kind envelopeKind, sender []byte, body []byte, err error) {
+    if len(data) < 2 || len(data) < 2 + int(data[1]) {
+        err = fmt.Errorf("envelope too short")
+        return
+    }
+    kind = envelopeKind(data[0])
+    sender = data[2:2 + int(data[1])]
+    body = data[2 + int(data[1]):]
+    return
+}
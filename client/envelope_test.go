@@ -0,0 +1,52 @@
+package client
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+    kind, sender, body, err := openEnvelope(
+        sealEnvelope(envBurn, []byte("alice"), []byte("hello")),
+    )
+    if err != nil {
+        t.Fatal(err)
+    }
+    if kind != envBurn || string(sender) != "alice" || string(body) != "hello" {
+        t.Fatalf("got %d '%s' '%s'", kind, sender, body)
+    }
+    for _, data := range [][]byte{nil, {0}, {0, 6, 'a', 'l'}} {
+        if _, _, _, err = openEnvelope(data); err == nil {
+            t.Fatalf("opened %v", data)
+        }
+    }
+}
+
+// A name announcement the server passes off as somebody else's still counts
+// for whoever sealed it.
+func TestSealedSenderWins(t *testing.T) {
+    alice, _ := newTestClient(t)
+    carol, carolConn := newTestClient(t)
+    carol.cfg.ident = []byte("carol")
+    key := newTestKey(t)
+    if err := alice.cfg.ring.install(1, bytes.Clone(key)); err != nil {
+        t.Fatal(err)
+    }
+    if err := carol.cfg.ring.install(1, key); err != nil {
+        t.Fatal(err)
+    }
+    carol.cfg.handles = true
+    carol.cfg.name = []byte("Carol")
+    if err := carol.announceName(false); err != nil {
+        t.Fatal(err)
+    }
+    if err := alice.handleMessage(relay(t, "bob", carolConn.msgs[0])); err != nil {
+        t.Fatal(err)
+    }
+    if _, ok := alice.names["bob"]; ok {
+        t.Fatal("took the server's word for who sent it")
+    }
+    if string(alice.names["carol"]) != "Carol" {
+        t.Fatalf("carol is '%s'", alice.names["carol"])
+    }
+}
@@ -0,0 +1,186 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/therekrab/blur/cfg"
+	"github.com/therekrab/blur/message"
+	"github.com/therekrab/blur/secure"
+	"github.com/therekrab/blur/ui"
+)
+
+const serverPinKind string = "ed25519"
+
+// The first time we talk to a server, we remember its key. After that, a
+// different key means somebody is in the middle, and we refuse to go on.
+func (client *Client) handleServerKey(pub []byte) (err error) {
+    err = client.checkPin(serverPinKind, "server key", secure.Fingerprint(pub))
+    if err != nil {
+        return
+    }
+    client.keyMu.Lock()
+    defer client.keyMu.Unlock()
+    client.serverKey = bytes.Clone(pub)
+    return
+}
+
+// Trusts fingerprint if it's the first one we see for this server (of this
+// kind), and otherwise only if it's the one we saw back then.
+func (client *Client) checkPin(
+    kind string,
+    what string,
+    fingerprint string,
+) (err error) {
+    pinned, found, err := cfg.LookupPin(client.addr, kind)
+    if err != nil {
+        return
+    }
+    if !found {
+        ui.Out("Trusting new %s %s\n", what, fingerprint)
+        return cfg.SavePin(client.addr, kind, fingerprint)
+    }
+    if pinned != fingerprint {
+        err = fmt.Errorf(
+            "%s for %s changed (now %s), refusing to continue",
+            what,
+            client.addr,
+            fingerprint,
+        )
+    }
+    return
+}
+
+// Events have to be signed by the server key, and come in order, so nobody
+// can forge or replay them.
+func (client *Client) verifyEvent(
+    kind message.EvtKind,
+    seq uint64,
+    payload []byte,
+    signature []byte,
+) bool {
+    if client.serverKey == nil || seq <= client.eventSeq {
+        return false
+    }
+    body := message.EventBody(client.cfg.sessionID, kind, seq, payload)
+    if !secure.VerifySignature(client.serverKey, body, signature) {
+        return false
+    }
+    client.eventSeq = seq
+    return true
+}
+
+func (client *Client) handleEvent(data []byte) (err error) {
+    kind, seq, payload, signature, err := message.ParseEvent(
+        data,
+        secure.SIGSIZE,
+    )
+    if err != nil {
+        return
+    }
+    client.keyMu.Lock()
+    defer client.keyMu.Unlock()
+    out := ui.Out
+    if !client.verifyEvent(kind, seq, payload, signature) {
+        if client.cfg.strict {
+            err = fmt.Errorf("dropped an event with a bad signature")
+            return
+        }
+        out = ui.OutWarn
+        out("[unverified] ")
+    }
+    switch kind {
+    case message.EvtJoin:
+        out("user '%s' has entered the session\n", client.displayName(payload))
+        client.seen(payload, true)
+    case message.EvtLeave:
+        out("user '%s' has exited the session\n", client.displayName(payload))
+        client.seen(payload, false)
+        client.forgetMember(payload)
+        delete(client.names, string(payload))
+    case message.EvtOwner:
+        out("'%s' is now an owner\n", client.displayName(payload))
+        if string(payload) == string(client.cfg.ident) {
+            client.owner = true
+        }
+        return
+    case message.EvtRename:
+        var oldIdent, newIdent []byte
+        oldIdent, newIdent, err = message.ParseRename(payload)
+        if err != nil {
+            return
+        }
+        out("'%s' is now '%s'\n", client.displayName(oldIdent), newIdent)
+        client.renameMember(oldIdent, newIdent)
+        client.seen(oldIdent, false)
+        client.seen(newIdent, true)
+        if string(oldIdent) == string(client.cfg.ident) {
+            client.cfg.ident = newIdent
+            if !client.cfg.handles {
+                client.cfg.name = newIdent
+            }
+        }
+        return
+    case message.EvtDemote:
+        out("'%s' is no longer an owner\n", client.displayName(payload))
+        if string(payload) == string(client.cfg.ident) {
+            client.owner = false
+        }
+        return
+    case message.EvtKick, message.EvtBan:
+        // They're gone without a leave event, and the next key mustn't reach
+        // them either.
+        if kind == message.EvtKick {
+            out("'%s' was kicked\n", client.displayName(payload))
+        } else {
+            out("'%s' was banned\n", client.displayName(payload))
+        }
+        client.seen(payload, false)
+        client.forgetMember(payload)
+        delete(client.names, string(payload))
+    case message.EvtLock:
+        out(
+            "'%s' locked the session, nobody new can join\n",
+            client.displayName(payload),
+        )
+        return
+    case message.EvtUnlock:
+        out("'%s' unlocked the session\n", client.displayName(payload))
+        return
+    case message.EvtKnock:
+        if client.owner {
+            out(
+                "'%s' wants to join: .admit %s / .deny %s\n",
+                payload,
+                payload,
+                payload,
+            )
+            return
+        }
+        out("'%s' wants to join\n", payload)
+        return
+    case message.EvtAdmit:
+        out("'%s' was let in\n", client.displayName(payload))
+        return
+    case message.EvtDeny:
+        out("'%s' was turned away\n", client.displayName(payload))
+        return
+    case message.EvtApprovalOn:
+        out(
+            "'%s' made new members wait for an owner to let them in\n",
+            client.displayName(payload),
+        )
+        return
+    case message.EvtApprovalOff:
+        out(
+            "'%s' let new members in without asking\n",
+            client.displayName(payload),
+        )
+        return
+    default:
+        return
+    }
+    if client.cfg.rekey.Roster {
+        client.scheduleRekey()
+    }
+    return
+}
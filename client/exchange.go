@@ -0,0 +1,180 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/therekrab/blur/message"
+	"github.com/therekrab/blur/secure"
+	"github.com/therekrab/blur/sender"
+	"github.com/therekrab/blur/ui"
+)
+
+func (client *Client) requestKey() (err error) {
+    client.keyMu.Lock()
+    defer client.keyMu.Unlock()
+    if client.cfg.kx == secure.Passphrase || client.cfg.hasKey() {
+        return
+    }
+    ui.Out("Waiting for a member to hand over the group key...\n")
+    return sender.SendKeyR(client.conn, client.cfg.keyPair.Public())
+}
+
+// Somebody is asking for the group key. Anybody who has it answers, and the
+// joiner keeps whichever answer arrives first.
+func (client *Client) handleKeyR(data []byte) (err error) {
+    source, pub, err := message.ParseCht(data)
+    if err != nil {
+        return
+    }
+    client.keyMu.Lock()
+    defer client.keyMu.Unlock()
+    if client.cfg.kx == secure.Passphrase {
+        return
+    }
+    if bytes.Equal(pub, client.cfg.keyPair.Public()) {
+        // That's just our own request coming back around.
+        return
+    }
+    client.addMember(pub, source)
+    if !client.cfg.hasKey() {
+        return
+    }
+    return client.sendKey(pub)
+}
+
+// Seals the group key to pub and sends it. The caller holds keyMu.
+func (client *Client) sendKey(pub []byte) (err error) {
+    ring := &client.cfg.ring
+    sealed, err := secure.SealKey(
+        client.cfg.kx,
+        ring.suite,
+        pub,
+        client.cfg.authKey.Bytes(),
+        ring.key.Bytes(),
+    )
+    if err != nil {
+        return
+    }
+    if client.originated {
+        client.handedTo[string(pub)] = true
+    }
+    return sender.SendKey(
+        client.conn,
+        pub,
+        client.cfg.keyPair.Public(),
+        ring.epoch,
+        sealed,
+    )
+}
+
+func (client *Client) handleKey(data []byte) (err error) {
+    source, keyData, err := message.ParseCht(data)
+    if err != nil {
+        return
+    }
+    client.keyMu.Lock()
+    defer client.keyMu.Unlock()
+    if client.cfg.kx == secure.Passphrase {
+        return
+    }
+    recipient, keySender, epoch, sealed, err := message.ParseKey(
+        keyData,
+        client.cfg.kx.PublicSize(),
+    )
+    if err != nil {
+        return
+    }
+    if !bytes.Equal(keySender, client.cfg.keyPair.Public()) {
+        // Answers go to everybody, which is how members learn about the ones
+        // that joined before them.
+        client.addMember(keySender, source)
+    }
+    if client.cfg.hasKey() {
+        switch {
+        case epoch == 0 && !client.handedTo[string(keySender)] &&
+            client.yields(source):
+            if err = client.yieldKey(source); err != nil {
+                return
+            }
+        case client.asking && epoch > client.cfg.ring.epoch:
+            // What we asked for (see askAgain).
+        default:
+            if bytes.Equal(recipient, client.cfg.keyPair.Public()) {
+                // The answer to our asking says we were up to date.
+                client.asking = false
+            }
+            return
+        }
+    }
+    if !bytes.Equal(recipient, client.cfg.keyPair.Public()) {
+        // Meant for somebody else.
+        return
+    }
+    key, err := client.cfg.keyPair.OpenKey(
+        client.cfg.ring.suite,
+        client.cfg.authKey.Bytes(),
+        sealed,
+    )
+    if err != nil {
+        err = fmt.Errorf("could not open the group key from '%s'", source)
+        return
+    }
+    if err = client.cfg.ring.install(epoch, key); err != nil {
+        return
+    }
+    client.originated = false
+    client.asking = false
+    ui.Out("Received the group key from '%s'\n", client.displayName(source))
+    if err = client.replayRekeys(); err != nil {
+        return
+    }
+    return client.announceName(true)
+}
+
+// A session that outlives its members also outlives their group key, so
+// whoever finds it empty starts a new one, and hands it to anybody who asked
+// for it in the meantime. The caller holds keyMu.
+func (client *Client) startAlone() (err error) {
+    key, err := secure.NewGroupKey()
+    if err != nil {
+        return
+    }
+    if err = client.cfg.ring.install(0, key); err != nil {
+        return
+    }
+    client.originated = true
+    client.handedTo = make(map[string]bool)
+    ui.Out("Nobody else is here, so a new group key was made\n")
+    for pub := range client.members {
+        if err = client.sendKey([]byte(pub)); err != nil {
+            return
+        }
+    }
+    return client.announceName(true)
+}
+
+// Two members can each find the session empty and start a key of their own,
+// and then neither can read the other. If so, the lowest ident keeps theirs,
+// and everybody else drops their own and asks for it. Only a key we made
+// ourselves, at epoch 0, is given up this way: anything after that was agreed
+// on with a REKEY. The caller holds keyMu.
+func (client *Client) yields(source []byte) bool {
+    if !client.originated || client.cfg.ring.epoch != 0 {
+        return false
+    }
+    return bytes.Compare(source, client.cfg.ident) < 0
+}
+
+// Ours is kept until theirs opens, since a frame or KEY saying otherwise
+// could have come from the server. The caller holds keyMu.
+func (client *Client) yieldKey(source []byte) (err error) {
+    if client.asking {
+        return
+    }
+    client.asking = true
+    ui.Out(
+        "'%s' started a group key too, switching to theirs...\n",
+        client.displayName(source),
+    )
+    return sender.SendKeyR(client.conn, client.cfg.keyPair.Public())
+}
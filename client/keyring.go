@@ -0,0 +1,164 @@
+package client
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"time"
+	"github.com/therekrab/blur/secure"
+)
+
+// How many epochs back we can still decrypt. Frames sealed just before a
+// rekey may arrive after it.
+const keptEpochs = 4
+
+// keyring holds the group key of the current epoch, and the keys of a few
+// epochs before it.
+type keyring struct {
+    suite secure.Suite
+    epoch uint32
+    key *secure.Secret
+    keys map[uint32]*secure.Secret
+    ciphers map[uint32]cipher.AEAD
+    // When the current epoch started, and how many frames it has carried.
+    started time.Time
+    frames uint
+}
+
+func (kr *keyring) ready() bool {
+    return kr.key != nil
+}
+
+// install takes key over, and zeroes it.
+func (kr *keyring) install(epoch uint32, key []byte) (err error) {
+    secret := secure.NewSecret(key)
+    aead, err := kr.suite.NewAEAD(secret.Bytes())
+    if err != nil {
+        secret.Wipe()
+        return
+    }
+    if kr.ciphers == nil {
+        kr.ciphers = make(map[uint32]cipher.AEAD)
+        kr.keys = make(map[uint32]*secure.Secret)
+    }
+    kr.keys[epoch].Wipe()
+    kr.keys[epoch] = secret
+    kr.ciphers[epoch] = aead
+    for old := range kr.ciphers {
+        if old + keptEpochs <= epoch {
+            kr.keys[old].Wipe()
+            delete(kr.keys, old)
+            delete(kr.ciphers, old)
+        }
+    }
+    kr.epoch = epoch
+    kr.key = secret
+    kr.started = time.Now()
+    kr.frames = 0
+    return
+}
+
+// Zeroes every key. The ciphers built from them keep copies we can't reach,
+// so the best we can do there is let go of them.
+func (kr *keyring) wipe() {
+    for _, key := range kr.keys {
+        key.Wipe()
+    }
+    kr.key = nil
+    kr.keys = nil
+    kr.ciphers = nil
+}
+
+// Every key we hold, so they can be sealed away while the session is locked:
+// whether the current key is usable (1 byte), then epoch (4) | key for each.
+// It's filled in place, so no copy is left behind, and the caller wipes it.
+func (kr *keyring) export() (data *secure.Secret) {
+    data = secure.AllocSecret(1 + len(kr.keys) * (4 + secure.KEYSIZE))
+    buf := data.Bytes()
+    if kr.ready() {
+        buf[0] = 1
+    }
+    at := 1
+    for epoch, key := range kr.keys {
+        binary.BigEndian.PutUint32(buf[at:at + 4], epoch)
+        copy(buf[at + 4:at + 4 + secure.KEYSIZE], key.Bytes())
+        at += 4 + secure.KEYSIZE
+    }
+    return
+}
+
+// Puts back what export returned, leaving the epoch and its counters alone.
+// data is zeroed.
+func (kr *keyring) restore(data []byte) (err error) {
+    defer secure.Zero(data)
+    if len(data) < 1 || (len(data) - 1) % (4 + secure.KEYSIZE) != 0 {
+        err = fmt.Errorf("invalid sealed keys")
+        return
+    }
+    ready := data[0] == 1
+    kr.keys = make(map[uint32]*secure.Secret)
+    kr.ciphers = make(map[uint32]cipher.AEAD)
+    for rest := data[1:]; len(rest) > 0; rest = rest[4 + secure.KEYSIZE:] {
+        epoch := binary.BigEndian.Uint32(rest[:4])
+        secret := secure.NewSecret(rest[4:4 + secure.KEYSIZE])
+        kr.keys[epoch] = secret
+        kr.ciphers[epoch], err = kr.suite.NewAEAD(secret.Bytes())
+        if err != nil {
+            return
+        }
+    }
+    if ready {
+        kr.key = kr.keys[kr.epoch]
+    }
+    return
+}
+
+// Every CHTE is tagged with the epoch of the key that sealed it.
+func (kr *keyring) encrypt(
+    data []byte,
+    padding secure.Padding,
+) (encrypted []byte, err error) {
+    if !kr.ready() {
+        err = fmt.Errorf("no group key")
+        return
+    }
+    sealed, err := secure.EncryptData(kr.ciphers[kr.epoch], data, padding)
+    if err != nil {
+        return
+    }
+    encrypted = binary.BigEndian.AppendUint32(nil, kr.epoch)
+    encrypted = append(encrypted, sealed...)
+    return
+}
+
+// Whether the frame was sealed in an epoch after ours.
+func (kr *keyring) ahead(encrypted []byte) bool {
+    if len(encrypted) < 4 {
+        return false
+    }
+    return binary.BigEndian.Uint32(encrypted[:4]) > kr.epoch
+}
+
+func (kr *keyring) decrypt(encrypted []byte) (data []byte, err error) {
+    if len(encrypted) < 4 {
+        err = fmt.Errorf("CHTE DATA too short")
+        return
+    }
+    epoch := binary.BigEndian.Uint32(encrypted[:4])
+    aead, ok := kr.ciphers[epoch]
+    if !ok {
+        err = fmt.Errorf("no key for epoch %d", epoch)
+        return
+    }
+    return secure.DecryptData(aead, encrypted[4:])
+}
+
+// Counts a frame that was decrypted, if it was sealed in the current epoch.
+func (kr *keyring) count(encrypted []byte) {
+    if len(encrypted) < 4 {
+        return
+    }
+    if binary.BigEndian.Uint32(encrypted[:4]) == kr.epoch {
+        kr.frames++
+    }
+}
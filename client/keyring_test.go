@@ -0,0 +1,155 @@
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"github.com/therekrab/blur/secure"
+)
+
+func newTestKey(t *testing.T) []byte {
+    t.Helper()
+    key, err := secure.NewGroupKey()
+    if err != nil {
+        t.Fatal(err)
+    }
+    return key
+}
+
+func TestKeyringInstall(t *testing.T) {
+    var ring keyring
+    if ring.ready() {
+        t.Fatal("ready without a key")
+    }
+    key := newTestKey(t)
+    if err := ring.install(3, key); err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Equal(key, make([]byte, secure.KEYSIZE)) {
+        t.Error("install left its copy of the key")
+    }
+    if !ring.ready() || ring.epoch != 3 {
+        t.Fatalf("ready %t at epoch %d", ring.ready(), ring.epoch)
+    }
+    encrypted, err := ring.encrypt([]byte("hello"), secure.NoPadding)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if epoch := binary.BigEndian.Uint32(encrypted); epoch != 3 {
+        t.Fatalf("tagged with epoch %d", epoch)
+    }
+    data, err := ring.decrypt(encrypted)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if string(data) != "hello" {
+        t.Fatalf("got '%s'", data)
+    }
+    ring.count(encrypted)
+    if ring.frames != 1 {
+        t.Fatalf("counted %d frames", ring.frames)
+    }
+    if err = ring.install(4, newTestKey(t)); err != nil {
+        t.Fatal(err)
+    }
+    if ring.frames != 0 {
+        t.Fatal("frames carried over to the next epoch")
+    }
+    // Frames from the epoch before still open, but don't count anymore.
+    if _, err = ring.decrypt(encrypted); err != nil {
+        t.Fatal(err)
+    }
+    ring.count(encrypted)
+    if ring.frames != 0 {
+        t.Fatal("counted a frame from the epoch before")
+    }
+}
+
+func TestKeyringAhead(t *testing.T) {
+    var ring keyring
+    if err := ring.install(5, newTestKey(t)); err != nil {
+        t.Fatal(err)
+    }
+    frame := func(epoch uint32) []byte {
+        return binary.BigEndian.AppendUint32(nil, epoch)
+    }
+    cases := map[uint32]bool{4: false, 5: false, 6: true, 100: true}
+    for epoch, want := range cases {
+        if got := ring.ahead(frame(epoch)); got != want {
+            t.Errorf("epoch %d: ahead %t", epoch, got)
+        }
+    }
+    if ring.ahead([]byte{0, 0, 0}) {
+        t.Error("a short frame is ahead")
+    }
+    if _, err := ring.decrypt(append(frame(6), make([]byte, 40)...)); err == nil {
+        t.Error("decrypted a frame from an epoch we have no key for")
+    }
+}
+
+// Only the last keptEpochs epochs are kept, and the ones before are wiped.
+func TestKeyringPrunes(t *testing.T) {
+    var ring keyring
+    var frames [][]byte
+    var secrets []*secure.Secret
+    for epoch := uint32(0); epoch < 2 * keptEpochs; epoch++ {
+        if err := ring.install(epoch, newTestKey(t)); err != nil {
+            t.Fatal(err)
+        }
+        secrets = append(secrets, ring.key)
+        encrypted, err := ring.encrypt([]byte("hello"), secure.NoPadding)
+        if err != nil {
+            t.Fatal(err)
+        }
+        frames = append(frames, encrypted)
+    }
+    if len(ring.keys) != keptEpochs || len(ring.ciphers) != keptEpochs {
+        t.Fatalf("kept %d keys and %d ciphers", len(ring.keys), len(ring.ciphers))
+    }
+    last := 2 * keptEpochs - 1
+    for epoch, encrypted := range frames {
+        kept := epoch > last - keptEpochs
+        if _, err := ring.decrypt(encrypted); kept != (err == nil) {
+            t.Errorf("epoch %d: kept %t, but %v", epoch, kept, err)
+        }
+        if wiped := secrets[epoch].Bytes() == nil; wiped == kept {
+            t.Errorf("epoch %d: kept %t, but wiped %t", epoch, kept, wiped)
+        }
+    }
+}
+
+// What export gives is enough to get every key back.
+func TestKeyringExportRestore(t *testing.T) {
+    var ring keyring
+    var frames [][]byte
+    for epoch := uint32(0); epoch < 3; epoch++ {
+        if err := ring.install(epoch, newTestKey(t)); err != nil {
+            t.Fatal(err)
+        }
+        encrypted, err := ring.encrypt([]byte("hello"), secure.NoPadding)
+        if err != nil {
+            t.Fatal(err)
+        }
+        frames = append(frames, encrypted)
+    }
+    data := ring.export()
+    defer data.Wipe()
+    if size := len(data.Bytes()); size != 1 + 3 * (4 + secure.KEYSIZE) {
+        t.Fatalf("exported %d bytes", size)
+    }
+    ring.wipe()
+    if ring.ready() {
+        t.Fatal("ready after wiping")
+    }
+    if err := ring.restore(data.Bytes()); err != nil {
+        t.Fatal(err)
+    }
+    if !ring.ready() || ring.epoch != 2 {
+        t.Fatalf("ready %t at epoch %d", ring.ready(), ring.epoch)
+    }
+    for epoch, encrypted := range frames {
+        if _, err := ring.decrypt(encrypted); err != nil {
+            t.Errorf("epoch %d: %s", epoch, err)
+        }
+    }
+}
@@ -0,0 +1,129 @@
+package client
+
+import (
+	"time"
+	"github.com/therekrab/blur/errorhandling"
+	"github.com/therekrab/blur/message"
+	"github.com/therekrab/blur/secure"
+	"github.com/therekrab/blur/sender"
+	"github.com/therekrab/blur/ui"
+)
+
+const lockPrompt = "Locked, session key: "
+
+// The most messages held while locked. Past that, the oldest are dropped, so
+// nobody can fill up our memory by talking while we're away.
+const maxPending = 1024
+
+func (client *Client) touch() {
+    client.keyMu.Lock()
+    defer client.keyMu.Unlock()
+    client.lastInput = time.Now()
+}
+
+func (client *Client) isLocked() bool {
+    client.keyMu.Lock()
+    defer client.keyMu.Unlock()
+    return client.locked
+}
+
+// Locks the session once nobody has typed anything for a while.
+func (client *Client) runLockLoop() {
+    timeout := client.cfg.lockTimeout
+    if timeout == 0 {
+        return
+    }
+    client.touch()
+    ticker := time.NewTicker(time.Second)
+    defer ticker.Stop()
+    for range ticker.C {
+        if !client.isActive() {
+            return
+        }
+        client.keyMu.Lock()
+        if !client.locked && time.Since(client.lastInput) >= timeout {
+            if err := client.lock(); err != nil {
+                errorhandling.Report(err, false)
+            }
+        }
+        client.keyMu.Unlock()
+    }
+}
+
+// Wipes the keys and everything on screen. Until the passphrase is entered
+// again, whatever arrives is held (still encrypted) by hold. The caller holds
+// keyMu.
+func (client *Client) lock() (err error) {
+    err = client.cfg.lock()
+    if err != nil {
+        return
+    }
+    client.locked = true
+    ui.Lock(lockPrompt)
+    ui.Out(
+        "Locked after %s without input. Enter the session key to unlock.\n",
+        client.cfg.lockTimeout,
+    )
+    return
+}
+
+// Holds msg for later if the session is locked.
+func (client *Client) hold(msg message.Message) bool {
+    client.keyMu.Lock()
+    defer client.keyMu.Unlock()
+    if !client.locked {
+        return false
+    }
+    if len(client.pending) >= maxPending {
+        // A key we miss this way is noticed and asked for again, like any
+        // other (see catchUp).
+        client.pending[0] = message.Message{}
+        client.pending = client.pending[1:]
+        client.dropped++
+    }
+    client.pending = append(client.pending, msg)
+    return true
+}
+
+func (client *Client) unlock(sessionKey string) {
+    client.keyMu.Lock()
+    err := client.cfg.unlock(sessionKey)
+    client.lastInput = time.Now()
+    if err == nil && client.cfg.kx != secure.Passphrase {
+        // Our key pair is a new one, which members learn about like they
+        // would from a joiner.
+        err = sender.SendKeyR(client.conn, client.cfg.keyPair.Public())
+    }
+    dropped := client.dropped
+    client.dropped = 0
+    client.keyMu.Unlock()
+    if err != nil {
+        errorhandling.Report(err, false)
+        return
+    }
+    ui.Unlock()
+    ui.Out("Unlocked.\n")
+    if dropped > 0 {
+        ui.Out("Dropped %d messages that arrived while locked.\n", dropped)
+    }
+    // Catch up on whatever arrived in the meantime, in order. The session
+    // counts as locked until the queue is empty, so nothing new can jump
+    // ahead of it.
+    for {
+        client.keyMu.Lock()
+        if len(client.pending) == 0 {
+            client.locked = false
+            client.keyMu.Unlock()
+            return
+        }
+        msg := client.pending[0]
+        client.pending = client.pending[1:]
+        client.keyMu.Unlock()
+        err = client.handleMessage(msg)
+        if err != nil {
+            errorhandling.Report(err, true)
+            client.Close()
+            errorhandling.Exit()
+        }
+    }
+}
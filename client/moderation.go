@@ -0,0 +1,107 @@
+package client
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"github.com/therekrab/blur/message"
+	"github.com/therekrab/blur/sender"
+	"github.com/therekrab/blur/ui"
+)
+
+// Handles the commands owners moderate the session with. The server decides
+// whether we're allowed to, and answers with an ERR if we're not.
+func (client *Client) moderate(line string) (handled bool, err error) {
+    command, arg, _ := strings.Cut(line, " ")
+    arg = strings.TrimSpace(arg)
+    switch command {
+    case ".claim":
+        var ownerSecret []byte
+        ownerSecret, err = hex.DecodeString(arg)
+        if err != nil || len(ownerSecret) == 0 {
+            return true, fmt.Errorf("usage: .claim <secret>")
+        }
+        client.keyMu.Lock()
+        client.cfg.SetOwnerSecret(ownerSecret)
+        client.keyMu.Unlock()
+        return true, sender.SendOwn(client.conn, ownerSecret)
+    case ".kick", ".ban":
+        if arg == "" {
+            return true, fmt.Errorf("usage: %s <name>", command)
+        }
+        action := message.ModKick
+        if command == ".ban" {
+            action = message.ModBan
+        }
+        return true, sender.SendMod(client.conn, action, client.identOf(arg))
+    case ".admit", ".deny":
+        if arg == "" {
+            return true, fmt.Errorf("usage: %s <name>", command)
+        }
+        action := message.ModAdmit
+        if command == ".deny" {
+            action = message.ModDeny
+        }
+        return true, sender.SendMod(client.conn, action, client.identOf(arg))
+    case ".promote", ".demote":
+        if arg == "" {
+            return true, fmt.Errorf("usage: %s <name>", command)
+        }
+        action := message.ModPromote
+        if command == ".demote" {
+            action = message.ModDemote
+        }
+        return true, sender.SendMod(client.conn, action, client.identOf(arg))
+    case ".approval":
+        switch arg {
+        case "on":
+            return true, sender.SendMod(client.conn, message.ModApprovalOn, nil)
+        case "off":
+            return true, sender.SendMod(client.conn, message.ModApprovalOff, nil)
+        }
+        return true, fmt.Errorf("usage: .approval on|off")
+    case ".lock":
+        return true, sender.SendMod(client.conn, message.ModLock, nil)
+    case ".unlock":
+        return true, sender.SendMod(client.conn, message.ModUnlock, nil)
+    }
+    return false, nil
+}
+
+// The server only knows members by their ident, which for members using
+// handles isn't what everybody calls them.
+func (client *Client) identOf(name string) []byte {
+    client.keyMu.Lock()
+    defer client.keyMu.Unlock()
+    for handle, handleName := range client.names {
+        if string(handleName) == name {
+            return []byte(handle)
+        }
+    }
+    return []byte(name)
+}
+
+func rejection(data []byte) error {
+    if len(data) < 1 {
+        return fmt.Errorf("rejected by the server")
+    }
+    switch message.RejReason(data[0]) {
+    case message.RejSession:
+        return fmt.Errorf("invalid sessionID")
+    case message.RejKey:
+        return fmt.Errorf("incrorect credentials")
+    case message.RejLocked:
+        return fmt.Errorf("the session is locked, nobody new can join")
+    case message.RejBanned:
+        return fmt.Errorf("you are banned from this session")
+    case message.RejDenied:
+        return fmt.Errorf("no owner let you in")
+    }
+    return fmt.Errorf("rejected by the server (%d)", data[0])
+}
+
+// ERR messages aren't signed, so they're only ever shown as what the server
+// claims.
+func showRefusal(data []byte) {
+    ui.OutWarn("The server refused: %s\n", data)
+}
@@ -0,0 +1,184 @@
+package client
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"github.com/therekrab/blur/message"
+	"github.com/therekrab/blur/sender"
+	"github.com/therekrab/blur/ui"
+)
+
+// Handles are all the server ever sees of a member that hides their name.
+const handleSize = 6
+
+func newHandle() (handle []byte, err error) {
+    random := make([]byte, handleSize)
+    if _, err = rand.Read(random); err != nil {
+        return
+    }
+    handle = []byte("anon-" + hex.EncodeToString(random))
+    return
+}
+
+// Names behind handles are always shown with the handle, which is what tells
+// apart two members who picked the same one. The caller holds keyMu.
+func (client *Client) displayName(ident []byte) string {
+    name, ok := client.names[string(ident)]
+    if client.cfg.handles && string(ident) == string(client.cfg.ident) {
+        name, ok = client.cfg.name, true
+    }
+    if ok {
+        return fmt.Sprintf("%s (%s)", name, ident)
+    }
+    return string(ident)
+}
+
+// The server let us in under another ident, because somebody already had
+// ours.
+func (client *Client) takeIdent(ident []byte) {
+    client.keyMu.Lock()
+    defer client.keyMu.Unlock()
+    ui.OutWarn("'%s' was taken, so you're '%s' here\n", client.cfg.ident, ident)
+    client.cfg.ident = ident
+    if !client.cfg.handles {
+        client.cfg.name = ident
+    }
+}
+
+// Asks to go by name from now on. With handles, the server never learns our
+// name, so only the other members are told.
+func (client *Client) nick(name string) (err error) {
+    name = strings.TrimSpace(name)
+    if name == "" {
+        return fmt.Errorf("usage: .nick <name>")
+    }
+    if err = message.ValidateIdent([]byte(name)); err != nil {
+        return
+    }
+    client.keyMu.Lock()
+    defer client.keyMu.Unlock()
+    if client.cfg.handles {
+        client.cfg.name = []byte(name)
+        ui.Out("You're now %s\n", name)
+        return client.announceName(false)
+    }
+    return sender.SendName(client.conn, []byte(name))
+}
+
+func (client *Client) nameOf(ident []byte) string {
+    client.keyMu.Lock()
+    defer client.keyMu.Unlock()
+    return client.displayName(ident)
+}
+
+// Tells the other members who is behind our handle. When we've just arrived,
+// we also ask them to do the same. The caller holds keyMu.
+func (client *Client) announceName(askBack bool) (err error) {
+    if !client.cfg.handles {
+        return
+    }
+    if askBack {
+        if client.announced {
+            return
+        }
+        client.announced = true
+    }
+    flag := byte(0)
+    if askBack {
+        flag = 1
+    }
+    body := append([]byte{flag}, client.cfg.name...)
+    encrypted, err := client.cfg.encrypt(envName, body)
+    if err != nil {
+        return
+    }
+    return sender.SendChatE(client.conn, encrypted)
+}
+
+func (client *Client) handleName(source []byte, body []byte) (err error) {
+    if len(body) < 1 {
+        err = fmt.Errorf("empty name announcement")
+        return
+    }
+    client.keyMu.Lock()
+    defer client.keyMu.Unlock()
+    if client.names == nil {
+        client.names = make(map[string][]byte)
+    }
+    if string(source) == string(client.cfg.ident) {
+        return
+    }
+    name := body[1:]
+    if err = message.ValidateIdent(name); err != nil {
+        // Nobody but us checks these, and anything that passes for another
+        // name (or messes up the screen) is better left unshown.
+        ui.OutWarn("'%s' announced a name that can't be shown: %s\n", source, err)
+        err = nil
+    } else {
+        client.learnName(source, name)
+    }
+    if body[0] == 1 {
+        // They just got here, so they don't know who we are either.
+        err = client.announceName(false)
+    }
+    return
+}
+
+// The caller holds keyMu.
+func (client *Client) learnName(source []byte, name []byte) {
+    known, ok := client.names[string(source)]
+    if ok && bytes.Equal(known, name) {
+        return
+    }
+    client.names[string(source)] = name
+    if !ok {
+        ui.Out("'%s' is %s\n", source, name)
+    } else {
+        ui.Out("'%s' is now %s\n", source, name)
+    }
+    if other, taken := client.nameTaken(source, name); taken {
+        ui.OutWarn(
+            "'%s' goes by %s, like '%s' does. Tell them apart by the handle.\n",
+            source,
+            name,
+            client.displayName(other),
+        )
+    }
+}
+
+// Who else, if anybody, goes by name: as their ident, or as the name behind
+// their handle. Case doesn't count, like with idents. The caller holds keyMu.
+func (client *Client) nameTaken(
+    source []byte,
+    name []byte,
+) (other []byte, taken bool) {
+    if bytes.EqualFold(name, client.cfg.name) {
+        return client.cfg.ident, true
+    }
+    for ident := range client.roster {
+        if ident != string(source) && bytes.EqualFold(name, []byte(ident)) {
+            return []byte(ident), true
+        }
+    }
+    for handle, known := range client.names {
+        if handle != string(source) && bytes.EqualFold(name, known) {
+            return []byte(handle), true
+        }
+    }
+    return
+}
+
+// Keeps track of who's here. The caller holds keyMu.
+func (client *Client) seen(ident []byte, present bool) {
+    if client.roster == nil {
+        client.roster = make(map[string]bool)
+    }
+    if present {
+        client.roster[string(ident)] = true
+    } else {
+        delete(client.roster, string(ident))
+    }
+}
@@ -0,0 +1,124 @@
+package client
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"golang.org/x/net/proxy"
+)
+
+// Accepts socks5://host:port (like Tor's 127.0.0.1:9050) and
+// http://host:port, with an optional user:password@. Either way, host names
+// are resolved by the proxy, not by us, so .onion addresses work and our DNS
+// server never learns where we're connecting.
+func parseProxy(spec string) (dialer proxy.Dialer, err error) {
+    u, err := url.Parse(spec)
+    if err != nil {
+        return
+    }
+    if u.Host == "" {
+        err = fmt.Errorf("invalid proxy: %s", spec)
+        return
+    }
+    switch u.Scheme {
+    case "socks5", "socks5h":
+        return proxy.FromURL(u, proxyForward{})
+    case "http":
+        connect := httpConnect{addr: u.Host}
+        if u.Port() == "" {
+            connect.addr = net.JoinHostPort(u.Hostname(), "8080")
+        }
+        if u.User != nil {
+            password, _ := u.User.Password()
+            credentials := u.User.Username() + ":" + password
+            connect.auth = "Basic " +
+                base64.StdEncoding.EncodeToString([]byte(credentials))
+        }
+        dialer = connect
+        return
+    }
+    err = fmt.Errorf("unsupported proxy type: %s", u.Scheme)
+    return
+}
+
+// We never got as far as the proxy. That's the only failure where connecting
+// directly instead doesn't go around something the proxy was told to do.
+type unreachableError struct {
+    err error
+}
+
+func (e *unreachableError) Error() string {
+    return e.err.Error()
+}
+
+func (e *unreachableError) Unwrap() error {
+    return e.err
+}
+
+// How we get to the proxy itself, marking when we can't.
+type proxyForward struct{}
+
+func (proxyForward) Dial(network string, addr string) (conn net.Conn, err error) {
+    conn, err = net.Dial(network, addr)
+    if err != nil {
+        err = &unreachableError{err}
+    }
+    return
+}
+
+// Tunnels through an HTTP proxy with CONNECT.
+type httpConnect struct {
+    addr string
+    // The Proxy-Authorization header, if any.
+    auth string
+}
+
+func (connect httpConnect) Dial(network string, addr string) (conn net.Conn, err error) {
+    conn, err = proxyForward{}.Dial("tcp", connect.addr)
+    if err != nil {
+        return
+    }
+    request := &http.Request{
+        Method: http.MethodConnect,
+        URL: &url.URL{Opaque: addr},
+        Host: addr,
+        Header: make(http.Header),
+    }
+    if connect.auth != "" {
+        request.Header.Set("Proxy-Authorization", connect.auth)
+    }
+    if err = request.Write(conn); err != nil {
+        conn.Close()
+        return
+    }
+    reader := bufio.NewReader(conn)
+    response, err := http.ReadResponse(reader, request)
+    if err != nil {
+        conn.Close()
+        return
+    }
+    response.Body.Close()
+    if response.StatusCode != http.StatusOK {
+        conn.Close()
+        err = fmt.Errorf("proxy refused to connect: %s", response.Status)
+        return
+    }
+    if reader.Buffered() > 0 {
+        // The server never talks first, so this shouldn't happen, but
+        // anything already read must not get lost.
+        conn = &bufferedConn{Conn: conn, reader: reader}
+    }
+    return
+}
+
+type bufferedConn struct {
+    net.Conn
+    reader *bufio.Reader
+}
+
+func (conn *bufferedConn) Read(b []byte) (int, error) {
+    return conn.reader.Read(b)
+}
@@ -0,0 +1,110 @@
+package client
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// An address nothing listens on.
+func closedAddr(t *testing.T) string {
+    t.Helper()
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    addr := listener.Addr().String()
+    listener.Close()
+    return addr
+}
+
+// Counts the connections it accepts.
+func listen(t *testing.T) (addr string, accepted chan net.Conn) {
+    t.Helper()
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { listener.Close() })
+    accepted = make(chan net.Conn, 4)
+    go func() {
+        for {
+            conn, err := listener.Accept()
+            if err != nil {
+                return
+            }
+            accepted <- conn
+        }
+    }()
+    return listener.Addr().String(), accepted
+}
+
+func proxyClient(t *testing.T, spec string, strict bool) *Client {
+    t.Helper()
+    client, _ := newTestClient(t)
+    if err := client.cfg.SetProxy(spec, strict); err != nil {
+        t.Fatal(err)
+    }
+    return client
+}
+
+func TestProxyUnreachableGoesDirect(t *testing.T) {
+    target, accepted := listen(t)
+    for _, scheme := range []string{"http", "socks5"} {
+        client := proxyClient(t, scheme + "://" + closedAddr(t), false)
+        conn, err := client.dialTCP(target)
+        if err != nil {
+            t.Fatalf("%s: %s", scheme, err)
+        }
+        conn.Close()
+        (<-accepted).Close()
+    }
+}
+
+func TestProxyUnreachableStrict(t *testing.T) {
+    target, accepted := listen(t)
+    client := proxyClient(t, "http://" + closedAddr(t), true)
+    if _, err := client.dialTCP(target); err == nil {
+        t.Fatal("went direct")
+    }
+    if len(accepted) != 0 {
+        t.Fatal("target was dialed")
+    }
+}
+
+// The proxy answered, so whatever it said, going around it is not an option.
+func TestProxyRefusedNeverDirect(t *testing.T) {
+    target, accepted := listen(t)
+    proxyAddr, proxied := listen(t)
+    go func() {
+        conn := <-proxied
+        defer conn.Close()
+        if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+            return
+        }
+        conn.Write([]byte("HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n"))
+    }()
+    client := proxyClient(t, "http://" + proxyAddr, false)
+    if _, err := client.dialTCP(target); err == nil {
+        t.Fatal("went direct")
+    }
+    if len(accepted) != 0 {
+        t.Fatal("target was dialed")
+    }
+}
+
+func TestProxyOnionNeverDirect(t *testing.T) {
+    client := proxyClient(t, "socks5://" + closedAddr(t), false)
+    for _, addr := range []string{
+        "abcdefghijklmnop.onion:4040",
+        "ABCDEFGHIJKLMNOP.ONION.:4040",
+    } {
+        // Going direct would fail too, just differently.
+        _, err := client.dialTCP(addr)
+        if err == nil || !strings.Contains(err.Error(), "through the proxy") {
+            t.Fatalf("%s: went direct (%v)", addr, err)
+        }
+    }
+}
@@ -0,0 +1,305 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"time"
+	"github.com/therekrab/blur/errorhandling"
+	"github.com/therekrab/blur/message"
+	"github.com/therekrab/blur/secure"
+	"github.com/therekrab/blur/sender"
+	"github.com/therekrab/blur/ui"
+)
+
+// Every member notices the same triggers at about the same time, so each one
+// waits a random moment before rekeying. The server relays in order, so the
+// first REKEY for an epoch wins everywhere and the rest are ignored.
+const rekeyJitter = 2 * time.Second
+
+type heldRekey struct {
+    source []byte
+    body []byte
+}
+
+// Members only have one key pair at a time, so a new one (say, after they
+// unlocked) replaces the last. The caller holds keyMu.
+func (client *Client) addMember(pub []byte, ident []byte) {
+    if client.members == nil {
+        client.members = make(map[string][]byte)
+    }
+    client.forgetMember(ident)
+    client.members[string(pub)] = ident
+}
+
+// The caller holds keyMu.
+func (client *Client) forgetMember(ident []byte) {
+    for pub, memberIdent := range client.members {
+        if bytes.Equal(memberIdent, ident) {
+            delete(client.members, pub)
+        }
+    }
+}
+
+// So that when they leave, it's still them we forget. The caller holds keyMu.
+func (client *Client) renameMember(oldIdent []byte, newIdent []byte) {
+    for pub, memberIdent := range client.members {
+        if bytes.Equal(memberIdent, oldIdent) {
+            client.members[pub] = newIdent
+        }
+    }
+    if name, ok := client.names[string(oldIdent)]; ok {
+        delete(client.names, string(oldIdent))
+        client.names[string(newIdent)] = name
+    }
+}
+
+// The caller holds keyMu.
+func (client *Client) scheduleRekey() {
+    ring := &client.cfg.ring
+    if client.cfg.kx == secure.Passphrase || !ring.ready() {
+        return
+    }
+    if client.rekeyScheduled && client.rekeyEpoch == ring.epoch + 1 {
+        return
+    }
+    client.rekeyScheduled = true
+    client.rekeyEpoch = ring.epoch + 1
+    epoch := ring.epoch
+    time.AfterFunc(rand.N(rekeyJitter), func() {
+        client.keyMu.Lock()
+        defer client.keyMu.Unlock()
+        if !client.isActive() {
+            return
+        }
+        if !client.cfg.ring.ready() || client.cfg.ring.epoch != epoch {
+            // Somebody else got there first.
+            return
+        }
+        if err := client.sendRekey(); err != nil {
+            errorhandling.Report(err, false)
+        }
+    })
+}
+
+func (client *Client) Rekey() (err error) {
+    client.keyMu.Lock()
+    defer client.keyMu.Unlock()
+    if client.cfg.kx == secure.Passphrase {
+        err = fmt.Errorf("rekeying needs a session using key exchange")
+        return
+    }
+    if !client.cfg.ring.ready() {
+        err = fmt.Errorf("no group key yet")
+        return
+    }
+    client.rekeyScheduled = true
+    client.rekeyEpoch = client.cfg.ring.epoch + 1
+    return client.sendRekey()
+}
+
+// Seals a fresh group key to every member we know about, ourselves included,
+// and MACs the lot with the current key so only members can rekey. Whoever
+// has left is simply not on the list. The caller holds keyMu.
+func (client *Client) sendRekey() (err error) {
+    ring := &client.cfg.ring
+    key, err := secure.NewGroupKey()
+    if err != nil {
+        return
+    }
+    // We install it like everybody else, when our REKEY comes back around.
+    defer secure.Zero(key)
+    rekey := message.Rekey{
+        Epoch: ring.epoch + 1,
+        Sender: client.cfg.keyPair.Public(),
+    }
+    recipients := [][]byte{rekey.Sender}
+    for pub := range client.members {
+        recipients = append(recipients, []byte(pub))
+    }
+    for _, recipient := range recipients {
+        var sealed []byte
+        sealed, err = secure.SealKey(
+            client.cfg.kx,
+            ring.suite,
+            recipient,
+            client.cfg.authKey.Bytes(),
+            key,
+        )
+        if err != nil {
+            return
+        }
+        rekey.Entries = append(rekey.Entries, message.RekeyEntry{
+            Recipient: secure.Hash(recipient),
+            Sealed: sealed,
+        })
+    }
+    data := rekey.Bytes()
+    data = append(data, secure.MAC(ring.key.Bytes(), data)...)
+    return sender.SendRekey(client.conn, data)
+}
+
+func (client *Client) handleRekey(data []byte) (err error) {
+    source, body, err := message.ParseCht(data)
+    if err != nil {
+        return
+    }
+    client.keyMu.Lock()
+    defer client.keyMu.Unlock()
+    if client.cfg.kx == secure.Passphrase {
+        return
+    }
+    return client.applyRekey(source, body)
+}
+
+// The caller holds keyMu.
+func (client *Client) applyRekey(source []byte, body []byte) (err error) {
+    rekey, mac, signed, err := message.ParseRekey(
+        body,
+        client.cfg.kx.PublicSize(),
+        secure.MACSIZE,
+    )
+    if err != nil {
+        return
+    }
+    ring := &client.cfg.ring
+    own := client.cfg.keyPair.Public()
+    ownHash := secure.Hash(own)
+    if !ring.ready() {
+        // The key this one replaces may still be on its way (a member can
+        // rekey between answering our KEYR and us reading the answer), so
+        // keep it for when that arrives, if it's any use to us.
+        if slices.ContainsFunc(rekey.Entries, func(entry message.RekeyEntry) bool {
+            return bytes.Equal(entry.Recipient, ownHash)
+        }) {
+            client.holdRekey(source, body)
+        }
+        return
+    }
+    if rekey.Epoch != ring.epoch + 1 {
+        // This one lost the race.
+        return
+    }
+    if !secure.VerifyMAC(ring.key.Bytes(), signed, mac) {
+        err = fmt.Errorf("rejected a rekey from '%s'", source)
+        return
+    }
+    if !bytes.Equal(rekey.Sender, own) {
+        client.addMember(rekey.Sender, source)
+    }
+    for _, entry := range rekey.Entries {
+        if !bytes.Equal(entry.Recipient, ownHash) {
+            continue
+        }
+        var key []byte
+        key, err = client.cfg.keyPair.OpenKey(
+            ring.suite,
+            client.cfg.authKey.Bytes(),
+            entry.Sealed,
+        )
+        if err != nil {
+            return
+        }
+        err = ring.install(rekey.Epoch, key)
+        if err != nil {
+            return
+        }
+        client.originated = false
+        ui.Out(
+            "Group key rotated by '%s' (epoch %d)\n",
+            client.displayName(source),
+            rekey.Epoch,
+        )
+        return
+    }
+    // Whoever rekeyed didn't know about us yet.
+    return client.askAgain()
+}
+
+// Asks for the current key like a joiner would, but keeps the one we have
+// until an answer actually opens (see handleKey): what made us ask may well be
+// the server making things up. The caller holds keyMu.
+func (client *Client) askAgain() (err error) {
+    if client.asking {
+        return
+    }
+    client.asking = true
+    ui.Out("Missed the group key rotation, asking again...\n")
+    return sender.SendKeyR(client.conn, client.cfg.keyPair.Public())
+}
+
+// A REKEY that came before we had the key it replaces. Only the last few are
+// kept; anything older than that, we'll notice we missed (see catchUp). The
+// caller holds keyMu.
+func (client *Client) holdRekey(source []byte, body []byte) {
+    client.heldRekeys = append(client.heldRekeys, heldRekey{source, body})
+    if len(client.heldRekeys) > keptEpochs {
+        client.heldRekeys = client.heldRekeys[1:]
+    }
+}
+
+// Goes through the REKEYs that came too early, now that we have a key. Each
+// one only applies if it follows the one before. The caller holds keyMu.
+func (client *Client) replayRekeys() (err error) {
+    held := client.heldRekeys
+    client.heldRekeys = nil
+    for _, rekey := range held {
+        if err = client.applyRekey(rekey.source, rekey.body); err != nil {
+            return
+        }
+    }
+    return
+}
+
+// A frame from an epoch we have no key for may mean a rekey got past us. That's
+// no reason to leave: ask for the current key. The epoch is in the clear, so
+// anybody can claim it, and we only move on once a member's answer opens. A
+// frame we can't open at epoch 0 may also be from somebody who started a key
+// at the same time as us (see yields).
+func (client *Client) catchUp(source []byte, encrypted []byte) (err error) {
+    client.keyMu.Lock()
+    defer client.keyMu.Unlock()
+    ring := &client.cfg.ring
+    if client.cfg.kx == secure.Passphrase || !ring.ready() {
+        return
+    }
+    if ring.ahead(encrypted) {
+        return client.askAgain()
+    }
+    if client.yields(source) {
+        return client.yieldKey(source)
+    }
+    return
+}
+
+func (client *Client) runRekeyLoop() {
+    if client.cfg.kx == secure.Passphrase || client.cfg.rekey.Interval == 0 {
+        return
+    }
+    ticker := time.NewTicker(time.Second)
+    defer ticker.Stop()
+    for range ticker.C {
+        if !client.isActive() {
+            return
+        }
+        client.keyMu.Lock()
+        ring := &client.cfg.ring
+        if ring.ready() && time.Since(ring.started) >= client.cfg.rekey.Interval {
+            client.scheduleRekey()
+        }
+        client.keyMu.Unlock()
+    }
+}
+
+// Called after each frame we decrypt, other than cover traffic, which would
+// otherwise bring rekeys forward.
+func (client *Client) countFrame(encrypted []byte) {
+    client.keyMu.Lock()
+    defer client.keyMu.Unlock()
+    client.cfg.ring.count(encrypted)
+    limit := client.cfg.rekey.Messages
+    if limit > 0 && client.cfg.ring.frames >= limit {
+        client.scheduleRekey()
+    }
+}
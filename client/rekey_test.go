@@ -0,0 +1,161 @@
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"github.com/therekrab/blur/message"
+	"github.com/therekrab/blur/secure"
+)
+
+// Keeps every message the client sends.
+type recordConn struct {
+    net.Conn
+    sent []message.MType
+    msgs []message.Message
+}
+
+func (conn *recordConn) Write(b []byte) (int, error) {
+    if len(b) >= 3 {
+        conn.sent = append(conn.sent, message.MType(b[2]))
+        data := bytes.Clone(b[3:])
+        conn.msgs = append(conn.msgs, message.NewMessage(
+            uint16(len(data)),
+            message.MType(b[2]),
+            data,
+        ))
+    }
+    return len(b), nil
+}
+
+func newTestClient(t *testing.T) (client *Client, conn *recordConn) {
+    t.Helper()
+    cfg, err := NewSessionConfig("key", "alice", secure.X25519, secure.AES256GCM)
+    if err != nil {
+        t.Fatal(err)
+    }
+    conn = &recordConn{}
+    client = &Client{cfg: cfg, conn: conn}
+    return
+}
+
+func chte(t *testing.T, source string, data []byte) message.Message {
+    t.Helper()
+    return relay(t, source, message.NewMessage(uint16(len(data)), message.CHTE, data))
+}
+
+// What the server makes of msg from source.
+func relay(t *testing.T, source string, msg message.Message) message.Message {
+    t.Helper()
+    msg, err := msg.PrependSource([]byte(source))
+    if err != nil {
+        t.Fatal(err)
+    }
+    return msg
+}
+
+// The epoch on a frame is in the clear, so a frame claiming to be from a later
+// one is no reason to give up the key we have. We only ask.
+func TestAheadFrameKeepsKey(t *testing.T) {
+    client, conn := newTestClient(t)
+    forged := binary.BigEndian.AppendUint32(nil, client.cfg.ring.epoch + 1)
+    forged = append(forged, make([]byte, 40)...)
+    for i := 0; i < 3; i++ {
+        if err := client.handleMessage(chte(t, "mallory", forged)); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if !client.hasKey() {
+        t.Fatal("dropped the key")
+    }
+    if !client.asking {
+        t.Fatal("didn't ask for the current key")
+    }
+    keyRs := 0
+    for _, mtype := range conn.sent {
+        if mtype == message.KEYR {
+            keyRs++
+        }
+    }
+    if keyRs != 1 {
+        t.Fatalf("asked %d times", keyRs)
+    }
+    // Our own messages still go out under the key we have.
+    if _, err := client.encrypt(envText, []byte("hello")); err != nil {
+        t.Fatal(err)
+    }
+}
+
+// Once a member's answer opens, the key it holds replaces ours.
+func TestAnswerReplacesKey(t *testing.T) {
+    alice, _ := newTestClient(t)
+    bob, bobConn := newTestClient(t)
+    bob.cfg.authKey = alice.cfg.authKey
+    if err := bob.cfg.ring.install(1, newTestKey(t)); err != nil {
+        t.Fatal(err)
+    }
+    forged := binary.BigEndian.AppendUint32(nil, 1)
+    forged = append(forged, make([]byte, 40)...)
+    if err := alice.handleMessage(chte(t, "bob", forged)); err != nil {
+        t.Fatal(err)
+    }
+    // Somebody's answer that doesn't open changes nothing.
+    mallory, malloryConn := newTestClient(t)
+    if err := mallory.cfg.ring.install(1, newTestKey(t)); err != nil {
+        t.Fatal(err)
+    }
+    if err := mallory.sendKey(alice.cfg.keyPair.Public()); err != nil {
+        t.Fatal(err)
+    }
+    alice.handleMessage(relay(t, "bob", malloryConn.msgs[0]))
+    if alice.cfg.ring.epoch != 0 || !alice.hasKey() {
+        t.Fatalf("at epoch %d with key %t", alice.cfg.ring.epoch, alice.hasKey())
+    }
+    if err := bob.sendKey(alice.cfg.keyPair.Public()); err != nil {
+        t.Fatal(err)
+    }
+    if err := alice.handleMessage(relay(t, "bob", bobConn.msgs[0])); err != nil {
+        t.Fatal(err)
+    }
+    if alice.cfg.ring.epoch != 1 || alice.asking {
+        t.Fatalf("at epoch %d, still asking %t", alice.cfg.ring.epoch, alice.asking)
+    }
+    encrypted, err := bob.encrypt(envText, []byte("hello"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, _, _, err = alice.decrypt(encrypted); err != nil {
+        t.Fatal(err)
+    }
+}
+
+// Cover traffic says nothing about how much the key has been used, so it
+// doesn't bring a rekey forward.
+func TestCoverNotCounted(t *testing.T) {
+    client, _ := newTestClient(t)
+    client.cfg.SetRekeyPolicy(RekeyPolicy{Messages: 2})
+    frame := func(kind envelopeKind) message.Message {
+        encrypted, err := client.encrypt(kind, []byte("hello"))
+        if err != nil {
+            t.Fatal(err)
+        }
+        return chte(t, "bob", encrypted)
+    }
+    for i := 0; i < 5; i++ {
+        if err := client.handleMessage(frame(envCover)); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if client.cfg.ring.frames != 0 || client.rekeyScheduled {
+        t.Fatalf("counted %d cover frames", client.cfg.ring.frames)
+    }
+    for i := 0; i < 2; i++ {
+        if err := client.handleMessage(frame(envText)); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if client.cfg.ring.frames != 2 || !client.rekeyScheduled {
+        t.Fatalf("counted %d frames", client.cfg.ring.frames)
+    }
+}
@@ -0,0 +1,139 @@
+package client
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"github.com/therekrab/blur/secure"
+	"github.com/therekrab/blur/ui"
+	"golang.org/x/net/websocket"
+)
+
+const tlsPinKind string = "tls"
+
+// Addresses starting with ws:// or wss:// go through a WebSocket (for
+// networks that only let HTTP out), and unix:/path is a Unix socket on this
+// host. Anything else is plain TCP. wss:// always uses TLS, ws:// never does.
+func (client *Client) dial() (conn net.Conn, err error) {
+    addr := client.addr
+    if strings.HasPrefix(addr, "ws://") || strings.HasPrefix(addr, "wss://") {
+        return client.dialWebSocket()
+    }
+    if path, found := strings.CutPrefix(addr, "unix:"); found {
+        conn, err = net.Dial("unix", path)
+    } else {
+        conn, err = client.dialTCP(addr)
+    }
+    if err != nil || !client.cfg.tls {
+        return
+    }
+    host, _, _ := net.SplitHostPort(addr)
+    return client.handshake(conn, host)
+}
+
+// Goes through the proxy, if there is one. Unless the proxy is strict, we
+// connect directly when the proxy can't be reached at all, but never when it
+// answered and said no, and never to a .onion address, which only the proxy
+// can reach anyway.
+func (client *Client) dialTCP(addr string) (conn net.Conn, err error) {
+    if client.cfg.proxy == nil {
+        return net.Dial("tcp", addr)
+    }
+    conn, err = client.cfg.proxy.Dial("tcp", addr)
+    if err == nil {
+        return
+    }
+    var unreachable *unreachableError
+    if client.cfg.proxyStrict || !errors.As(err, &unreachable) || isOnion(addr) {
+        err = fmt.Errorf("could not connect through the proxy: %w", err)
+        return
+    }
+    ui.OutWarn("Could not connect through the proxy (%s), going direct\n", err)
+    return net.Dial("tcp", addr)
+}
+
+func isOnion(addr string) bool {
+    host, _, err := net.SplitHostPort(addr)
+    if err != nil {
+        host = addr
+    }
+    host = strings.ToLower(strings.TrimSuffix(host, "."))
+    return strings.HasSuffix(host, ".onion")
+}
+
+func (client *Client) dialWebSocket() (conn net.Conn, err error) {
+    // Nothing on the server looks at the origin, but it has to be there.
+    config, err := websocket.NewConfig(client.addr, "http://localhost/")
+    if err != nil {
+        return
+    }
+    useTLS := config.Location.Scheme == "wss"
+    host := config.Location.Hostname()
+    port := config.Location.Port()
+    if port == "" {
+        port = "80"
+        if useTLS {
+            port = "443"
+        }
+    }
+    conn, err = client.dialTCP(net.JoinHostPort(host, port))
+    if err != nil {
+        return
+    }
+    if useTLS {
+        conn, err = client.handshake(conn, host)
+        if err != nil {
+            return
+        }
+    }
+    ws, err := websocket.NewClient(config, conn)
+    if err != nil {
+        conn.Close()
+        return
+    }
+    ws.PayloadType = websocket.BinaryFrame
+    conn = ws
+    return
+}
+
+func (client *Client) handshake(
+    conn net.Conn,
+    serverName string,
+) (tlsConn net.Conn, err error) {
+    wrapped := tls.Client(conn, &tls.Config{
+        ServerName: serverName,
+        // The certificate is self-signed, so there's no chain to check. We
+        // check its fingerprint in verifyCertificate instead.
+        InsecureSkipVerify: true,
+        MinVersion: tls.VersionTLS13,
+        VerifyConnection: client.verifyCertificate,
+    })
+    if err = wrapped.Handshake(); err != nil {
+        conn.Close()
+        return
+    }
+    tlsConn = wrapped
+    return
+}
+
+func (client *Client) verifyCertificate(state tls.ConnectionState) (err error) {
+    if len(state.PeerCertificates) == 0 {
+        err = fmt.Errorf("server sent no TLS certificate")
+        return
+    }
+    fingerprint := secure.Fingerprint(state.PeerCertificates[0].Raw)
+    if client.cfg.tlsPin == "" {
+        return client.checkPin(tlsPinKind, "TLS certificate", fingerprint)
+    }
+    if fingerprint != client.cfg.tlsPin {
+        err = fmt.Errorf(
+            "TLS certificate for %s is %s, not the expected %s",
+            client.addr,
+            fingerprint,
+            client.cfg.tlsPin,
+        )
+    }
+    return
+}
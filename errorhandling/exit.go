@@ -2,10 +2,13 @@ package errorhandling
 
 import (
 	"os"
+    "github.com/therekrab/blur/secure"
     "github.com/therekrab/blur/ui"
 )
 
 func Exit() {
+    // Whatever keys are still around go first.
+    secure.WipeAll()
     // Regular system exits
     failed := hadError()
     if failed {
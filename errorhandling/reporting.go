@@ -1,6 +1,7 @@
 package errorhandling
 
 import (
+	"github.com/therekrab/blur/secure"
 	"github.com/therekrab/blur/ui"
 )
 
@@ -8,6 +9,8 @@ func Report(err error, fatal bool) {
     ui.Err("err:\t%s\n", err)
     if fatal {
         fatalError()
+        // There's no going on from here, so the keys won't be needed again.
+        secure.WipeAll()
     }
 }
 
@@ -1,19 +1,22 @@
 module github.com/therekrab/blur
 
-go 1.23.4
+go 1.24.0
 
 require (
+	github.com/BurntSushi/toml v1.4.0 // direct
 	github.com/gdamore/tcell/v2 v2.7.1 // direct
 	github.com/rivo/tview v0.0.0-20241227133733-17b7edb88c57 // direct
+	github.com/sethvargo/go-diceware v0.4.0 // direct
+	golang.org/x/crypto v0.31.0 // direct
+	golang.org/x/net v0.33.0 // direct
+	golang.org/x/sys v0.28.0 // direct
 )
 
 require (
-	github.com/BurntSushi/toml v1.4.0 // indirect
 	github.com/gdamore/encoding v1.0.0 // indirect
 	github.com/lucasb-eyer/go-colorful v1.2.0 // indirect
 	github.com/mattn/go-runewidth v0.0.15 // indirect
 	github.com/rivo/uniseg v0.4.7 // indirect
-	golang.org/x/sys v0.17.0 // indirect
-	golang.org/x/term v0.17.0 // indirect
-	golang.org/x/text v0.14.0 // indirect
+	golang.org/x/term v0.27.0 // indirect
+	golang.org/x/text v0.21.0 // indirect
 )
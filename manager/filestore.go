@@ -0,0 +1,162 @@
+package manager
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Every change is appended to the file as a line of JSON: a record when a
+// session is saved, or just its ID when it's deleted. Opening the store
+// replays the file, then rewrites it with only what's left, so it never grows
+// much past the number of live sessions.
+type fileStore struct {
+    mu sync.Mutex
+    path string
+    file *os.File
+    records map[uint16]SessionRecord
+}
+
+type fileEntry struct {
+    SessionRecord
+    Deleted bool `json:"deleted,omitempty"`
+}
+
+func OpenFileStore(path string) (store SessionStore, err error) {
+    fs := &fileStore{
+        path: path,
+        records: make(map[uint16]SessionRecord),
+    }
+    if err = fs.replay(); err != nil {
+        return
+    }
+    if err = fs.compact(); err != nil {
+        return
+    }
+    return fs, nil
+}
+
+func (fs *fileStore) replay() (err error) {
+    file, err := os.Open(fs.path)
+    if os.IsNotExist(err) {
+        return nil
+    }
+    if err != nil {
+        return
+    }
+    defer file.Close()
+    scanner := bufio.NewScanner(file)
+    scanner.Buffer(make([]byte, 0, 4096), 1 << 20)
+    line := 0
+    var bad error
+    for scanner.Scan() {
+        line++
+        if bad != nil {
+            return bad
+        }
+        var entry fileEntry
+        if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+            // Fine if it's the last line, which a crash may have cut short.
+            bad = fmt.Errorf("%s:%d: %s", fs.path, line, err)
+            continue
+        }
+        if entry.Deleted {
+            delete(fs.records, entry.ID)
+        } else {
+            fs.records[entry.ID] = entry.SessionRecord
+        }
+    }
+    return scanner.Err()
+}
+
+// Writes the live records to a new file and swaps it in, so a crash halfway
+// through leaves the old one in place.
+func (fs *fileStore) compact() (err error) {
+    tmpPath := fs.path + ".tmp"
+    tmp, err := os.OpenFile(
+        tmpPath,
+        os.O_CREATE|os.O_TRUNC|os.O_WRONLY,
+        0600,
+    )
+    if err != nil {
+        return
+    }
+    writer := bufio.NewWriter(tmp)
+    for _, record := range fs.records {
+        if err = writeEntry(writer, fileEntry{SessionRecord: record}); err != nil {
+            tmp.Close()
+            return
+        }
+    }
+    if err = writer.Flush(); err != nil {
+        tmp.Close()
+        return
+    }
+    if err = tmp.Sync(); err != nil {
+        tmp.Close()
+        return
+    }
+    if err = tmp.Close(); err != nil {
+        return
+    }
+    if err = os.Rename(tmpPath, fs.path); err != nil {
+        return
+    }
+    fs.file, err = os.OpenFile(fs.path, os.O_APPEND|os.O_WRONLY, 0600)
+    return
+}
+
+func writeEntry(writer io.Writer, entry fileEntry) (err error) {
+    line, err := json.Marshal(entry)
+    if err != nil {
+        return
+    }
+    _, err = writer.Write(append(line, '\n'))
+    return
+}
+
+// Appends the entry and waits for it to hit the disk.
+func (fs *fileStore) append(entry fileEntry) (err error) {
+    if err = writeEntry(fs.file, entry); err != nil {
+        return
+    }
+    return fs.file.Sync()
+}
+
+func (fs *fileStore) Load() (records []SessionRecord, err error) {
+    fs.mu.Lock()
+    defer fs.mu.Unlock()
+    for _, record := range fs.records {
+        records = append(records, record)
+    }
+    return
+}
+
+func (fs *fileStore) Save(record SessionRecord) (err error) {
+    fs.mu.Lock()
+    defer fs.mu.Unlock()
+    fs.records[record.ID] = record
+    return fs.append(fileEntry{SessionRecord: record})
+}
+
+func (fs *fileStore) Delete(sessionID uint16) (err error) {
+    fs.mu.Lock()
+    defer fs.mu.Unlock()
+    delete(fs.records, sessionID)
+    entry := fileEntry{Deleted: true}
+    entry.ID = sessionID
+    return fs.append(entry)
+}
+
+func (fs *fileStore) Durable() bool {
+    return true
+}
+
+func (fs *fileStore) Close() (err error) {
+    fs.mu.Lock()
+    defer fs.mu.Unlock()
+    return fs.file.Close()
+}
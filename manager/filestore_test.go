@@ -0,0 +1,177 @@
+package manager
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openTestStore(t *testing.T, path string) SessionStore {
+    t.Helper()
+    store, err := OpenFileStore(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { store.Close() })
+    return store
+}
+
+func loadIDs(t *testing.T, store SessionStore) (ids []uint16) {
+    t.Helper()
+    records, err := store.Load()
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, record := range records {
+        ids = append(ids, record.ID)
+    }
+    slices.Sort(ids)
+    return
+}
+
+func lines(t *testing.T, path string) int {
+    t.Helper()
+    data, err := os.ReadFile(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return strings.Count(string(data), "\n")
+}
+
+// Whatever was saved, and not deleted since, is back after reopening, with
+// the last save of each session winning.
+func TestFileStoreReplay(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "sessions")
+    store := openTestStore(t, path)
+    for id := uint16(1); id <= 3; id++ {
+        if err := store.Save(SessionRecord{ID: id, TTL: time.Minute}); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := store.Save(SessionRecord{ID: 2, TTL: time.Hour, Locked: true}); err != nil {
+        t.Fatal(err)
+    }
+    if err := store.Delete(3); err != nil {
+        t.Fatal(err)
+    }
+    store.Close()
+    reopened := openTestStore(t, path)
+    if ids := loadIDs(t, reopened); !slices.Equal(ids, []uint16{1, 2}) {
+        t.Fatalf("got sessions %v", ids)
+    }
+    records, _ := reopened.Load()
+    for _, record := range records {
+        if record.ID == 2 && (record.TTL != time.Hour || !record.Locked) {
+            t.Fatalf("got an older save: %+v", record)
+        }
+    }
+}
+
+// A crash may cut the last line short, which costs that change and nothing
+// else. Anything broken before the end means the file can't be trusted.
+func TestFileStoreTruncated(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "sessions")
+    store := openTestStore(t, path)
+    for id := uint16(1); id <= 2; id++ {
+        if err := store.Save(SessionRecord{ID: id}); err != nil {
+            t.Fatal(err)
+        }
+    }
+    store.Close()
+    file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+    if err != nil {
+        t.Fatal(err)
+    }
+    file.WriteString(`{"id":3,"ttl":`)
+    file.Close()
+    reopened := openTestStore(t, path)
+    if ids := loadIDs(t, reopened); !slices.Equal(ids, []uint16{1, 2}) {
+        t.Fatalf("got sessions %v", ids)
+    }
+    reopened.Close()
+    data, err := os.ReadFile(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    broken := append([]byte("{\"id\":\n"), data...)
+    if err = os.WriteFile(path, broken, 0600); err != nil {
+        t.Fatal(err)
+    }
+    if _, err = OpenFileStore(path); err == nil {
+        t.Fatal("opened with a broken line in the middle")
+    }
+}
+
+// Opening the store rewrites it with one line per live session, however many
+// changes it took to get there.
+func TestFileStoreCompacts(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "sessions")
+    store := openTestStore(t, path)
+    for i := 0; i < 10; i++ {
+        if err := store.Save(SessionRecord{ID: 1, TTL: time.Duration(i)}); err != nil {
+            t.Fatal(err)
+        }
+        if err := store.Save(SessionRecord{ID: 2}); err != nil {
+            t.Fatal(err)
+        }
+        if err := store.Delete(2); err != nil {
+            t.Fatal(err)
+        }
+    }
+    store.Close()
+    if n := lines(t, path); n != 30 {
+        t.Fatalf("%d lines before compacting", n)
+    }
+    reopened := openTestStore(t, path)
+    if n := lines(t, path); n != 1 {
+        t.Fatalf("%d lines after compacting", n)
+    }
+    if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+        t.Fatal("left the temporary file behind")
+    }
+    // And it keeps appending after that.
+    if err := reopened.Save(SessionRecord{ID: 4}); err != nil {
+        t.Fatal(err)
+    }
+    if n := lines(t, path); n != 2 {
+        t.Fatalf("%d lines after saving", n)
+    }
+}
+
+// Deleting a session that's saved again later (say, under a reused ID)
+// brings it back, and deleting it again takes it out for good.
+func TestFileStoreDeleteRoundTrip(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "sessions")
+    store := openTestStore(t, path)
+    steps := []struct {
+        save bool
+        want []uint16
+    }{
+        {true, []uint16{7}},
+        {false, nil},
+        {true, []uint16{7}},
+        {false, nil},
+    }
+    for i, step := range steps {
+        var err error
+        if step.save {
+            err = store.Save(SessionRecord{ID: 7})
+        } else {
+            err = store.Delete(7)
+        }
+        if err != nil {
+            t.Fatal(err)
+        }
+        if ids := loadIDs(t, store); !slices.Equal(ids, step.want) {
+            t.Fatalf("step %d: got sessions %v", i, ids)
+        }
+        store.Close()
+        store = openTestStore(t, path)
+        if ids := loadIDs(t, store); !slices.Equal(ids, step.want) {
+            t.Fatalf("step %d, reopened: got sessions %v", i, ids)
+        }
+    }
+}
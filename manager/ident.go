@@ -0,0 +1,103 @@
+package manager
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"fmt"
+	"net"
+	"github.com/therekrab/blur/message"
+)
+
+// What to do when somebody joins with an ident that's already taken.
+type DuplicatePolicy byte
+
+const (
+    // Turn them away, so they can pick another one.
+    DuplicateReject DuplicatePolicy = iota
+    // Let them in as `bob-2` (or `bob-3`, and so on).
+    DuplicateSuffix
+)
+
+func ParseDuplicatePolicy(name string) (policy DuplicatePolicy, err error) {
+    switch name {
+    case "", "reject":
+        policy = DuplicateReject
+    case "suffix":
+        policy = DuplicateSuffix
+    default:
+        err = fmt.Errorf("unknown duplicate ident policy: %s", name)
+    }
+    return
+}
+
+// Whether nobody in the session (besides self, if that's not nil) goes by
+// ident yet. Case doesn't count, since `Bob` and `bob` are too easily mixed
+// up. The caller holds mu.
+func (smgr *sessionManager) identFreeLocked(ident []byte, self net.Conn) bool {
+    for conn, other := range smgr.clients {
+        if conn != self && bytes.EqualFold(other, ident) {
+            return false
+        }
+    }
+    return true
+}
+
+// The ident to let somebody asking for ident in as, according to policy. The
+// caller holds mu.
+func (smgr *sessionManager) uniqueIdentLocked(
+    ident []byte,
+    policy DuplicatePolicy,
+) (unique []byte, err error) {
+    if smgr.identFreeLocked(ident, nil) {
+        return ident, nil
+    }
+    if policy == DuplicateReject {
+        err = fmt.Errorf("somebody is already called '%s'", ident)
+        return
+    }
+    base := []rune(string(ident))
+    for n := 2; ; n++ {
+        suffix := fmt.Sprintf("-%d", n)
+        end := min(len(base), message.MaxIdentLength - len(suffix))
+        unique = []byte(string(base[:end]) + suffix)
+        if smgr.identFreeLocked(unique, nil) {
+            return
+        }
+    }
+}
+
+// Lets a member go by another ident from now on. Unlike when joining, a taken
+// one is never suffixed: they asked for that name, and can pick another.
+func (smgr *sessionManager) rename(
+    sessionID uint16,
+    signingKey ed25519.PrivateKey,
+    conn net.Conn,
+    ident []byte,
+) (err error) {
+    smgr.mu.Lock()
+    defer smgr.mu.Unlock()
+    old, ok := smgr.clients[conn]
+    if !ok {
+        err = fmt.Errorf("conn not in client list")
+        return
+    }
+    if bytes.Equal(old, ident) {
+        err = fmt.Errorf("you're already called '%s'", ident)
+        return
+    }
+    if !smgr.identFreeLocked(ident, conn) {
+        err = fmt.Errorf("somebody is already called '%s'", ident)
+        return
+    }
+    err = smgr.eventLocked(
+        sessionID,
+        signingKey,
+        message.EvtRename,
+        message.RenamePayload(old, ident),
+    )
+    if err != nil {
+        return
+    }
+    smgr.clients[conn] = ident
+    return
+}
@@ -1,19 +1,52 @@
 package manager
 
 import (
+	"crypto/ed25519"
 	"crypto/rand"
 	"encoding/binary"
 	"fmt"
 	"math"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 	"github.com/therekrab/blur/errorhandling"
 	"github.com/therekrab/blur/message"
+	"github.com/therekrab/blur/secure"
+	"github.com/therekrab/blur/ui"
 )
 
+// Sessions are spread over this many shards, each with a lock of its own, so
+// looking one session up never waits on another being created or torn down.
+// Everything else only locks the session itself.
+const shardCount = 64
+
+// How long a session nobody has joined yet is kept around.
+const joinGrace = time.Minute
+
+const ownerSecretSize = 32
+
+type shard struct {
+    mu sync.RWMutex
+    smgrs map[uint16]*sessionManager
+    // Sessions that are gone, but may still be in the store. Their IDs
+    // aren't handed out again until they're deleted from it.
+    dropping map[uint16]bool
+}
+
 type Manager struct {
-    smgrs map[uint16]sessionManager
+    shards [shardCount]shard
+    // How many sessions there are, across all shards.
+    sessions atomic.Int64
     mu sync.Mutex
+    // Signs every event, so clients can tell them from forgeries.
+    signingKey ed25519.PrivateKey
+    // The longest a session may outlive its last client.
+    maxTTL time.Duration
+    // Where sessions are kept, so they survive a restart.
+    store SessionStore
+    // What happens to those joining under an ident that's already taken.
+    duplicates DuplicatePolicy
 }
 
 var mgr *Manager
@@ -21,61 +54,245 @@ var once sync.Once
 
 func GetManager() *Manager {
     once.Do(func() {
-        mgr = &Manager{}
-        mgr.smgrs = make(map[uint16]sessionManager, 0)
+        mgr = &Manager{store: NewMemoryStore()}
+        for i := range mgr.shards {
+            mgr.shards[i].smgrs = make(map[uint16]*sessionManager)
+        }
     })
     return mgr
 }
 
-func (mgr *Manager) getSessionManager(sessionID uint16) *sessionManager {
-    smgr, ok := mgr.smgrs[sessionID]
-    if !ok {
-        return nil
+func (mgr *Manager) SetSigningKey(key ed25519.PrivateKey) {
+    mgr.mu.Lock()
+    defer mgr.mu.Unlock()
+    mgr.signingKey = key
+}
+
+func (mgr *Manager) getSigningKey() ed25519.PrivateKey {
+    mgr.mu.Lock()
+    defer mgr.mu.Unlock()
+    return mgr.signingKey
+}
+
+func (mgr *Manager) ServerKey() []byte {
+    mgr.mu.Lock()
+    defer mgr.mu.Unlock()
+    return mgr.signingKey.Public().(ed25519.PublicKey)
+}
+
+func (mgr *Manager) SetMaxTTL(maxTTL time.Duration) {
+    mgr.mu.Lock()
+    defer mgr.mu.Unlock()
+    mgr.maxTTL = maxTTL
+}
+
+func (mgr *Manager) SetDuplicatePolicy(policy DuplicatePolicy) {
+    mgr.mu.Lock()
+    defer mgr.mu.Unlock()
+    mgr.duplicates = policy
+}
+
+func (mgr *Manager) getDuplicatePolicy() DuplicatePolicy {
+    mgr.mu.Lock()
+    defer mgr.mu.Unlock()
+    return mgr.duplicates
+}
+
+// Replaces the store, bringing back every session in it. Nobody is in them
+// anymore, so they're kept as long as they'd be kept after everybody left
+// (and at least for joinGrace, for sessions that aren't kept at all).
+func (mgr *Manager) SetStore(store SessionStore) (restored int, err error) {
+    records, err := store.Load()
+    if err != nil {
+        return
+    }
+    for _, record := range records {
+        // The server may allow less than it did when the session was made.
+        ttl := mgr.grantTTL(record.TTL)
+        sh := mgr.shardFor(record.ID)
+        sh.mu.Lock()
+        if _, taken := sh.smgrs[record.ID]; !taken {
+            smgr := newSessionManager(nil, record.Params, ttl)
+            smgr.restore(record)
+            sh.smgrs[record.ID] = smgr
+            mgr.sessions.Add(1)
+            restored++
+        }
+        sh.mu.Unlock()
     }
-    return &smgr
+    mgr.mu.Lock()
+    defer mgr.mu.Unlock()
+    mgr.store.Close()
+    mgr.store = store
+    return
 }
 
+func (mgr *Manager) getStore() SessionStore {
+    mgr.mu.Lock()
+    defer mgr.mu.Unlock()
+    return mgr.store
+}
+
+// The session is in memory either way, so failing to store it is only worth
+// a report.
+func (mgr *Manager) save(sessionID uint16, smgr *sessionManager) {
+    if err := mgr.getStore().Save(smgr.record(sessionID)); err != nil {
+        err = fmt.Errorf("could not store session %x: %s", sessionID, err)
+        errorhandling.Report(err, false)
+    }
+}
+
+// The caller holds the shard lock, and calls unstore once it has let go of
+// it: deleting from the store may wait on the disk, and nothing else in the
+// shard should wait with it.
+func (mgr *Manager) drop(sh *shard, sessionID uint16) {
+    delete(sh.smgrs, sessionID)
+    mgr.sessions.Add(-1)
+    if sh.dropping == nil {
+        sh.dropping = make(map[uint16]bool)
+    }
+    sh.dropping[sessionID] = true
+}
+
+// Only after this can the session ID be handed out again, so a new session
+// under it is never deleted from the store along with the old one.
+func (mgr *Manager) unstore(sh *shard, sessionID uint16) {
+    if err := mgr.getStore().Delete(sessionID); err != nil {
+        err = fmt.Errorf("could not unstore session %x: %s", sessionID, err)
+        errorhandling.Report(err, false)
+    }
+    sh.mu.Lock()
+    defer sh.mu.Unlock()
+    delete(sh.dropping, sessionID)
+}
+
+// Clamps the TTL a creator asked for to what the server allows.
+func (mgr *Manager) grantTTL(ttl time.Duration) time.Duration {
+    mgr.mu.Lock()
+    defer mgr.mu.Unlock()
+    return min(ttl, mgr.maxTTL)
+}
+
+// Drops every session that has been empty for longer than its TTL, checking
+// again every so often, until stop is closed.
+func (mgr *Manager) RunReaper(every time.Duration, stop chan struct{}) {
+    ticker := time.NewTicker(every)
+    defer ticker.Stop()
+    for {
+        select {
+        case <- stop:
+            return
+        case now := <- ticker.C:
+            mgr.reap(now)
+        }
+    }
+}
+
+func (mgr *Manager) reap(now time.Time) {
+    for i := range mgr.shards {
+        sh := &mgr.shards[i]
+        var expired []uint16
+        sh.mu.Lock()
+        for sessionID, smgr := range sh.smgrs {
+            if smgr.expire(now) {
+                mgr.drop(sh, sessionID)
+                expired = append(expired, sessionID)
+            }
+        }
+        sh.mu.Unlock()
+        for _, sessionID := range expired {
+            mgr.unstore(sh, sessionID)
+            ui.Log("[ SERVER ] Session %x expired\n", sessionID)
+        }
+    }
+}
+
+func (mgr *Manager) shardFor(sessionID uint16) *shard {
+    return &mgr.shards[sessionID % shardCount]
+}
+
+// The session may be torn down as soon as the shard lock is released, which
+// its own lock (and closed flag) take care of.
+func (mgr *Manager) getSessionManager(sessionID uint16) *sessionManager {
+    sh := mgr.shardFor(sessionID)
+    sh.mu.RLock()
+    defer sh.mu.RUnlock()
+    return sh.smgrs[sessionID]
+}
+
+// Lets the client in and announces it. Whether it gets in under another
+// ident when its own is taken depends on the duplicate policy; joined is the
+// ident it got in as.
 func (mgr *Manager) AddClient(
     sessionID uint16,
     ident []byte,
     conn net.Conn,
-) {
-    mgr.mu.Lock() // gotta be safe
-    defer mgr.mu.Unlock() // gotta avoid dead locks
+) (joined []byte, err error) {
+    if err = message.ValidateIdent(ident); err != nil {
+        return
+    }
     smgr := mgr.getSessionManager(sessionID)
     if smgr == nil {
-        err := fmt.Errorf("invalid session ID: %x", sessionID)
-        errorhandling.Report(err, false)
+        err = fmt.Errorf("invalid session ID: %x", sessionID)
         return
     }
-    smgr.addClient(conn, ident)
+    return smgr.addClient(
+        sessionID,
+        mgr.getSigningKey(),
+        conn,
+        ident,
+        mgr.getDuplicatePolicy(),
+    )
 }
 
-func (mgr *Manager) RemoveClient(
+// Lets the client go by another ident, and tells everybody.
+func (mgr *Manager) Rename(
     sessionID uint16,
-    ident []byte,
     conn net.Conn,
-) {
-    mgr.mu.Lock()
-    defer mgr.mu.Unlock()
+    ident []byte,
+) (err error) {
+    if err = message.ValidateIdent(ident); err != nil {
+        return
+    }
     smgr := mgr.getSessionManager(sessionID)
     if smgr == nil {
+        err = fmt.Errorf("invalid session ID: %x", sessionID)
+        return
+    }
+    return smgr.rename(sessionID, mgr.getSigningKey(), conn, ident)
+}
+
+// Reports whether the client was still in the session to leave it. Whoever
+// was kicked or banned is already gone, and has been announced as such.
+func (mgr *Manager) RemoveClient(
+    sessionID uint16,
+    ident []byte,
+    conn net.Conn,
+) (left bool) {
+    sh := mgr.shardFor(sessionID)
+    sh.mu.Lock()
+    smgr, ok := sh.smgrs[sessionID]
+    if !ok {
+        sh.mu.Unlock()
         err := fmt.Errorf("invalid session ID: %x", sessionID)
         errorhandling.Report(err, false)
         return
     }
-    smgr.removeClient(conn)
-    if smgr.isEmpty() {
-        delete(mgr.smgrs, sessionID)
+    left, closed := smgr.removeClient(sessionID, mgr.getSigningKey(), conn)
+    if closed {
+        mgr.drop(sh, sessionID)
+    }
+    sh.mu.Unlock()
+    if closed {
+        mgr.unstore(sh, sessionID)
     }
+    return
 }
 
 func (mgr *Manager) Broadcast(
     sessionID uint16,
     msg message.Message,
 ) (err error) {
-    mgr.mu.Lock()
-    defer mgr.mu.Unlock()
     smgr := mgr.getSessionManager(sessionID)
     if smgr == nil {
         err = fmt.Errorf("invalid sessionID for broadcast")
@@ -85,57 +302,209 @@ func (mgr *Manager) Broadcast(
     return
 }
 
-func (mgr *Manager) newSessionID() (sessionID uint16, err error) {
-    if len(mgr.smgrs) > math.MaxUint16 / 3 * 2 {
+// Numbers, signs and broadcasts an event. Doing all of that under the
+// session's lock keeps the sequence numbers in the order clients receive them.
+func (mgr *Manager) BroadcastEvent(
+    sessionID uint16,
+    kind message.EvtKind,
+    payload []byte,
+) (err error) {
+    smgr := mgr.getSessionManager(sessionID)
+    if smgr == nil {
+        err = fmt.Errorf("invalid sessionID for event")
+        return
+    }
+    signingKey := mgr.getSigningKey()
+    smgr.mu.Lock()
+    defer smgr.mu.Unlock()
+    return smgr.eventLocked(sessionID, signingKey, kind, payload)
+}
+
+// The session persists for ttl after its last client leaves, or as long as
+// the server allows, whichever is shorter. granted is what it got. Whoever
+// knows ownerSecret can make themselves an owner of the session.
+func (mgr *Manager) NewSession(
+    sessionKeyHash []byte,
+    salt []byte,
+    params []byte,
+    ttl time.Duration,
+) (sessionID uint16, granted time.Duration, ownerSecret []byte, err error) {
+    if mgr.sessions.Add(1) > math.MaxUint16 / 3 * 2 {
         // If we're over two-thirds full, we won't take any more clients
         // This prevents us from filling up the server, and taking forever
         // to assign a new session ID.
+        mgr.sessions.Add(-1)
         err = fmt.Errorf("too many connections")
         return
     }
+    ownerSecret = make([]byte, ownerSecretSize)
+    if _, err = rand.Read(ownerSecret); err != nil {
+        mgr.sessions.Add(-1)
+        return
+    }
+    granted = mgr.grantTTL(ttl)
+    smgr := newSessionManager(sessionKeyHash, params, granted)
+    smgr.ownerHash = secure.Hash(ownerSecret)
+    smgr.salt = salt
+    // Only a store that outlives the server is worth the slow hash. Otherwise
+    // the verifier never leaves memory anyway.
+    if mgr.getStore().Durable() {
+        if smgr.keySalt, err = secure.NewSalt(); err != nil {
+            mgr.sessions.Add(-1)
+            return
+        }
+        smgr.keyHash = hashVerifier(sessionKeyHash, smgr.keySalt)
+    }
     for {
         sessionIDBytes := make([]byte, 2) // 2 bytes = 16 bits
         _, err = rand.Read(sessionIDBytes)
         if err != nil {
+            mgr.sessions.Add(-1)
             return
         }
         sessionID = binary.BigEndian.Uint16(sessionIDBytes)
-        if _, ok := mgr.smgrs[sessionID]; !ok {
-            // we can leave this loop!
+        sh := mgr.shardFor(sessionID)
+        sh.mu.Lock()
+        if _, taken := sh.smgrs[sessionID]; !taken && !sh.dropping[sessionID] {
+            sh.smgrs[sessionID] = smgr
+            sh.mu.Unlock()
+            mgr.save(sessionID, smgr)
             return
         }
+        sh.mu.Unlock()
     }
 }
 
-func (mgr *Manager) NewSession(sessionKeyHash []byte) (sessionID uint16, err error) {
-    mgr.mu.Lock()
-    defer mgr.mu.Unlock()
-    sessionID, err = mgr.newSessionID()
+// Whether conn may join the session as ident, and if not, why. Clients that
+// don't say who they are until they identify are checked for bans then (see
+// AddClient).
+func (mgr *Manager) Verify(
+    sessionID uint16,
+    sessionKeyHash []byte,
+    conn net.Conn,
+    ident []byte,
+) (ok bool, reason message.RejReason) {
+    if smgr := mgr.getSessionManager(sessionID); smgr != nil {
+        return smgr.verify(sessionKeyHash, conn, ident)
+    }
+    return false, message.RejSession
+}
+
+// Makes conn an owner of the session, if it knows the owner secret, and lets
+// everybody know.
+func (mgr *Manager) Claim(
+    sessionID uint16,
+    conn net.Conn,
+    ownerSecret []byte,
+) (err error) {
+    smgr := mgr.getSessionManager(sessionID)
+    if smgr == nil {
+        err = fmt.Errorf("invalid sessionID for claim")
+        return
+    }
+    claimed, err := smgr.claim(conn, ownerSecret)
+    if err != nil || !claimed {
+        return
+    }
+    ident, err := smgr.getIdent(conn)
+    if err != nil {
+        return
+    }
+    return mgr.BroadcastEvent(sessionID, message.EvtOwner, ident)
+}
+
+// Carries out a MOD message from conn, which has to be an owner. Whoever is
+// kicked or banned is disconnected.
+func (mgr *Manager) Moderate(
+    sessionID uint16,
+    conn net.Conn,
+    action message.ModAction,
+    arg []byte,
+) (err error) {
+    smgr := mgr.getSessionManager(sessionID)
+    if smgr == nil {
+        err = fmt.Errorf("invalid sessionID for moderation")
+        return
+    }
+    removed, err := smgr.moderate(
+        sessionID,
+        mgr.getSigningKey(),
+        conn,
+        action,
+        arg,
+    )
     if err != nil {
         return
     }
-    mgr.smgrs[sessionID] = newSessionManager(sessionKeyHash)
+    for _, target := range removed {
+        // Closing flushes what's queued for them, the event included, which
+        // may take a while.
+        go target.Close()
+    }
+    switch action {
+    case message.ModKick, message.ModAdmit, message.ModDeny:
+        // Nothing that outlives the connections involved.
+    default:
+        mgr.save(sessionID, smgr)
+    }
     return
 }
 
-func (mgr *Manager) Verify(
+// Asks the owners whether ident may join, and waits up to timeout for one of
+// them to decide. Sessions that don't need approval admit right away. Until
+// then, waiting is called, so the joiner can be told.
+func (mgr *Manager) Knock(
     sessionID uint16,
-    sessionKeyHash []byte,
-) (ok bool, keyFailed bool) {
-    mgr.mu.Lock()
-    defer mgr.mu.Unlock()
-    if smgr, found := mgr.smgrs[sessionID]; found {
-        ok = smgr.verify(sessionKeyHash)
-        return ok, !ok
+    ident []byte,
+    timeout time.Duration,
+    waiting func() error,
+) (admitted bool, err error) {
+    smgr := mgr.getSessionManager(sessionID)
+    if smgr == nil {
+        err = fmt.Errorf("invalid sessionID for knock")
+        return
+    }
+    decision, err := smgr.knock(sessionID, mgr.getSigningKey(), ident)
+    if err != nil || decision == nil {
+        return err == nil, err
+    }
+    defer smgr.unknock(ident, decision)
+    if err = waiting(); err != nil {
+        return
+    }
+    select {
+    case admitted = <- decision:
+    case <- time.After(timeout):
     }
     return
 }
 
-func (mgr *Manager) Identify(sessionID uint16) (idents [][]byte, err error) {
-    mgr.mu.Lock()
-    defer mgr.mu.Unlock()
-    if smgr, ok := mgr.smgrs[sessionID]; ok {
-        idents = smgr.identify()
+func (mgr *Manager) Params(sessionID uint16) (params []byte, err error) {
+    if smgr := mgr.getSessionManager(sessionID); smgr != nil {
+        params = smgr.params
+        return
+    }
+    err = fmt.Errorf("invalid sessionID for params request")
+    return
+}
+
+// What clients derive the session key hash with, handed to joiners before
+// they can present it.
+func (mgr *Manager) Salt(sessionID uint16) (salt []byte, err error) {
+    if smgr := mgr.getSessionManager(sessionID); smgr != nil {
+        salt = smgr.salt
+        return
+    }
+    err = fmt.Errorf("invalid sessionID for salt request")
+    return
+}
+
+// Everybody in the session, and who of them are owners.
+func (mgr *Manager) Identify(
+    sessionID uint16,
+) (idents [][]byte, owners [][]byte, err error) {
+    if smgr := mgr.getSessionManager(sessionID); smgr != nil {
+        idents, owners = smgr.identify()
         return
     }
     err = fmt.Errorf("invalid sessionID for identification request")
@@ -143,9 +512,7 @@ func (mgr *Manager) Identify(sessionID uint16) (idents [][]byte, err error) {
 }
 
 func (mgr *Manager) GetIdent(sessionID uint16, conn net.Conn) (ident []byte, err error) {
-    mgr.mu.Lock()
-    defer mgr.mu.Unlock()
-    if smgr, ok := mgr.smgrs[sessionID]; ok {
+    if smgr := mgr.getSessionManager(sessionID); smgr != nil {
         ident, err = smgr.getIdent(conn)
         return
     }
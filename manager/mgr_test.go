@@ -0,0 +1,129 @@
+package manager
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"github.com/therekrab/blur/message"
+)
+
+// A client that's always there and throws away whatever it's sent.
+type fakeConn struct {
+    net.Conn
+    addr net.Addr
+}
+
+func (conn *fakeConn) Write(b []byte) (int, error) {
+    return len(b), nil
+}
+
+func (conn *fakeConn) RemoteAddr() net.Addr {
+    return conn.addr
+}
+
+func (conn *fakeConn) Close() error {
+    return nil
+}
+
+var conns atomic.Int64
+
+func newFakeConn() *fakeConn {
+    n := conns.Add(1)
+    addr := &net.TCPAddr{IP: net.IPv4(10, byte(n >> 16), byte(n >> 8), byte(n)), Port: 4040}
+    return &fakeConn{addr: addr}
+}
+
+func newTestManager(tb testing.TB) *Manager {
+    tb.Helper()
+    mgr := &Manager{store: NewMemoryStore()}
+    for i := range mgr.shards {
+        mgr.shards[i].smgrs = make(map[uint16]*sessionManager)
+    }
+    _, key, err := ed25519.GenerateKey(nil)
+    if err != nil {
+        tb.Fatal(err)
+    }
+    mgr.SetSigningKey(key)
+    return mgr
+}
+
+// Sets up count sessions with somebody in each, so they stay open while
+// others come and go.
+func benchSessions(b *testing.B, mgr *Manager, count int) (ids []uint16) {
+    b.Helper()
+    for i := 0; i < count; i++ {
+        id, _, _, err := mgr.NewSession(nil, nil, nil, 0)
+        if err != nil {
+            b.Fatal(err)
+        }
+        if _, err = mgr.AddClient(id, []byte("resident"), newFakeConn()); err != nil {
+            b.Fatal(err)
+        }
+        ids = append(ids, id)
+    }
+    return
+}
+
+// Runs work on every goroutine, each in a session of its own when there are
+// enough of them, or all in the same one. With sessions only locking
+// themselves, the first should scale with the number of goroutines, and the
+// second shouldn't.
+func runSessions(
+    b *testing.B,
+    work func(mgr *Manager, id uint16, worker int64) func(),
+) {
+    for _, shared := range []bool{false, true} {
+        name := "distinct"
+        if shared {
+            name = "single"
+        }
+        b.Run(name, func(b *testing.B) {
+            mgr := newTestManager(b)
+            count := 1
+            if !shared {
+                count = 256
+            }
+            ids := benchSessions(b, mgr, count)
+            var workers atomic.Int64
+            b.ReportAllocs()
+            b.ResetTimer()
+            b.RunParallel(func(pb *testing.PB) {
+                worker := workers.Add(1)
+                op := work(mgr, ids[int(worker) % len(ids)], worker)
+                for pb.Next() {
+                    op()
+                }
+            })
+        })
+    }
+}
+
+func BenchmarkAddClient(b *testing.B) {
+    runSessions(b, func(mgr *Manager, id uint16, worker int64) func() {
+        conn := newFakeConn()
+        ident := []byte(fmt.Sprintf("joiner-%d", worker))
+        return func() {
+            if _, err := mgr.AddClient(id, ident, conn); err != nil {
+                b.Error(err)
+                return
+            }
+            mgr.RemoveClient(id, ident, conn)
+        }
+    })
+}
+
+func BenchmarkBroadcast(b *testing.B) {
+    msg, err := message.NewChat(make([]byte, 200))
+    if err != nil {
+        b.Fatal(err)
+    }
+    runSessions(b, func(mgr *Manager, id uint16, worker int64) func() {
+        return func() {
+            if err := mgr.Broadcast(id, msg); err != nil {
+                b.Error(err)
+            }
+        }
+    })
+}
@@ -0,0 +1,37 @@
+//go:build linux
+
+package manager
+
+import (
+	"crypto/tls"
+	"net"
+	"strconv"
+	"golang.org/x/sys/unix"
+)
+
+// The user on the other end of a Unix socket, as the kernel tells it.
+func peerUser(conn net.Conn) (uid string, ok bool) {
+    if tlsConn, isTLS := conn.(*tls.Conn); isTLS {
+        conn = tlsConn.NetConn()
+    }
+    unixConn, isUnix := conn.(*net.UnixConn)
+    if !isUnix {
+        return
+    }
+    raw, err := unixConn.SyscallConn()
+    if err != nil {
+        return
+    }
+    var cred *unix.Ucred
+    controlErr := raw.Control(func(fd uintptr) {
+        cred, err = unix.GetsockoptUcred(
+            int(fd),
+            unix.SOL_SOCKET,
+            unix.SO_PEERCRED,
+        )
+    })
+    if controlErr != nil || err != nil {
+        return
+    }
+    return strconv.FormatUint(uint64(cred.Uid), 10), true
+}
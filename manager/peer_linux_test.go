@@ -0,0 +1,56 @@
+package manager
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"github.com/therekrab/blur/message"
+)
+
+// Connects to a fresh Unix socket, and returns the server's end.
+func unixPair(t *testing.T) net.Conn {
+    t.Helper()
+    ln, err := net.Listen("unix", filepath.Join(t.TempDir(), "blur.sock"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer ln.Close()
+    client, err := net.Dial("unix", ln.Addr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { client.Close() })
+    conn, err := ln.Accept()
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { conn.Close() })
+    return conn
+}
+
+// On a Unix socket, a ban holds against the user on the other end, under any
+// ident they come back with.
+func TestBanOnUnixSocket(t *testing.T) {
+    mgr := newTestManager(t)
+    id, owner := newTestSession(t, mgr)
+    if _, err := mgr.AddClient(id, []byte("bob"), unixPair(t)); err != nil {
+        t.Fatal(err)
+    }
+    err := mgr.Moderate(id, owner, message.ModBan, []byte("bob"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, ident := range []string{"bob", "h-5f3a9c1e"} {
+        ok, reason := mgr.Verify(id, nil, unixPair(t), []byte(ident))
+        if ok || reason != message.RejBanned {
+            t.Errorf("'%s': ok %t, reason %d", ident, ok, reason)
+        }
+        if _, err = mgr.AddClient(id, []byte(ident), unixPair(t)); err == nil {
+            t.Errorf("'%s' got back in", ident)
+        }
+    }
+    // Somebody on the network is still welcome.
+    if _, err = mgr.AddClient(id, []byte("carol"), newFakeConn()); err != nil {
+        t.Fatal(err)
+    }
+}
@@ -1,39 +1,208 @@
 package manager
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/subtle"
 	"fmt"
 	"net"
-	"slices"
+	"sync"
+	"time"
 	"github.com/therekrab/blur/errorhandling"
 	"github.com/therekrab/blur/message"
+	"github.com/therekrab/blur/secure"
 )
 
+// Each session has its own lock, so sessions never wait on each other.
+// salt, keySalt, keyHash and params never change, so they're read without it.
 type sessionManager struct {
+    mu sync.Mutex
     clients map[net.Conn][]byte
+    // What joiners have to present, and what's stored in its place: a salted,
+    // slow hash of it. A session restored from the store only has the hash,
+    // until somebody gets in (see keyMatches).
     sessionKeyHash []byte
+    keySalt []byte
+    keyHash []byte
+    // What clients derive the key hash (and their keys) with. Anybody who
+    // asks gets it.
+    salt []byte
+    // Opaque to the server. Handed back to every joiner in ACC.
+    params []byte
+    // The sequence number of the last event in the session.
+    eventSeq uint64
+    // How long the session outlives its last client. Zero means it doesn't.
+    ttl time.Duration
+    // When the last client left (or the session was made, before anybody
+    // joined). Zero while anybody is in it.
+    emptySince time.Time
+    // Set when the session is dropped. Anybody still holding on to it can't
+    // join anymore.
+    closed bool
+    // Whoever proves they know the secret with this hash becomes an owner.
+    ownerHash []byte
+    owners map[net.Conn]bool
+    // When each client joined, counting joins, so the oldest can take over
+    // once the last owner is gone.
+    joined map[net.Conn]uint64
+    joins uint64
+    // Who may not join (see banKey), and whether anybody new may.
+    banned map[string]bool
+    locked bool
+    // Whether joiners wait for an owner to let them in, and the decisions
+    // the ones waiting are waiting for, by ident.
+    approval bool
+    knocks map[string]chan bool
 }
 
-func newSessionManager(sessionKeyHash []byte) (smgr sessionManager) {
+func newSessionManager(
+    sessionKeyHash []byte,
+    params []byte,
+    ttl time.Duration,
+) (smgr *sessionManager) {
+    smgr = &sessionManager{}
     smgr.clients = make(map[net.Conn][]byte)
+    smgr.owners = make(map[net.Conn]bool)
+    smgr.joined = make(map[net.Conn]uint64)
+    smgr.banned = make(map[string]bool)
+    smgr.knocks = make(map[string]chan bool)
     smgr.sessionKeyHash = sessionKeyHash
+    smgr.params = params
+    smgr.ttl = ttl
+    smgr.emptySince = time.Now()
     return
 }
 
-func (smgr *sessionManager) addClient(conn net.Conn, ident []byte) {
-    smgr.clients[conn] = ident
+// What the store keeps of the session.
+func (smgr *sessionManager) record(sessionID uint16) SessionRecord {
+    smgr.mu.Lock()
+    defer smgr.mu.Unlock()
+    record := SessionRecord{
+        ID: sessionID,
+        Salt: smgr.salt,
+        KeySalt: smgr.keySalt,
+        KeyHash: smgr.keyHash,
+        Params: smgr.params,
+        TTL: smgr.ttl,
+        OwnerHash: smgr.ownerHash,
+        Locked: smgr.locked,
+        Approval: smgr.approval,
+    }
+    for fingerprint := range smgr.banned {
+        record.Banned = append(record.Banned, fingerprint)
+    }
+    return record
 }
 
-func (smgr *sessionManager) removeClient(conn net.Conn) {
-    delete(smgr.clients, conn)
+func (smgr *sessionManager) restore(record SessionRecord) {
+    smgr.salt = record.Salt
+    smgr.keySalt = record.KeySalt
+    smgr.keyHash = record.KeyHash
+    smgr.ownerHash = record.OwnerHash
+    smgr.locked = record.Locked
+    smgr.approval = record.Approval
+    for _, fingerprint := range record.Banned {
+        smgr.banned[fingerprint] = true
+    }
 }
 
-func (smgr *sessionManager) isEmpty() bool {
-    return len(smgr.clients) == 0
+// Lets the client in under an ident nobody else has, and tells everybody
+// (but the client itself) about it. In a session without owners (say, one
+// everybody left, or one restored from the store), the client takes over.
+func (smgr *sessionManager) addClient(
+    sessionID uint16,
+    signingKey ed25519.PrivateKey,
+    conn net.Conn,
+    ident []byte,
+    policy DuplicatePolicy,
+) (joined []byte, err error) {
+    smgr.mu.Lock()
+    defer smgr.mu.Unlock()
+    if smgr.closed {
+        err = fmt.Errorf("invalid session ID: %x", sessionID)
+        return
+    }
+    if smgr.bannedLocked(conn) {
+        err = fmt.Errorf("'%s' is banned from this session", ident)
+        return
+    }
+    joined, err = smgr.uniqueIdentLocked(ident, policy)
+    if err != nil {
+        return
+    }
+    err = smgr.eventLocked(sessionID, signingKey, message.EvtJoin, joined)
+    if err != nil {
+        return
+    }
+    smgr.clients[conn] = joined
+    smgr.joins++
+    smgr.joined[conn] = smgr.joins
+    smgr.emptySince = time.Time{}
+    err = smgr.handoverLocked(sessionID, signingKey)
+    if err != nil {
+        // The client is in either way, so this is no reason to turn it away.
+        errorhandling.Report(err, false)
+        err = nil
+    }
+    return
 }
 
+// Reports whether the client was still in the session (it isn't after being
+// kicked, say), and whether the session is closed for good, which happens when
+// the last client leaves a session that doesn't persist. If that was the last
+// owner, somebody else takes over.
+func (smgr *sessionManager) removeClient(
+    sessionID uint16,
+    signingKey ed25519.PrivateKey,
+    conn net.Conn,
+) (present bool, closed bool) {
+    smgr.mu.Lock()
+    defer smgr.mu.Unlock()
+    _, present = smgr.clients[conn]
+    smgr.forgetLocked(conn)
+    err := smgr.handoverLocked(sessionID, signingKey)
+    if err != nil {
+        errorhandling.Report(err, false)
+    }
+    if len(smgr.clients) == 0 {
+        smgr.emptySince = time.Now()
+        if smgr.ttl == 0 {
+            smgr.closed = true
+        }
+    }
+    return present, smgr.closed
+}
+
+// Closes the session if it has been empty for longer than it persists. A
+// session nobody has joined yet gets at least joinGrace, so its creator can
+// get through identification first.
+func (smgr *sessionManager) expire(now time.Time) (closed bool) {
+    smgr.mu.Lock()
+    defer smgr.mu.Unlock()
+    if len(smgr.clients) > 0 || smgr.emptySince.IsZero() {
+        return false
+    }
+    if now.Sub(smgr.emptySince) >= max(smgr.ttl, joinGrace) {
+        smgr.closed = true
+    }
+    return smgr.closed
+}
+
+// Only queues the message for each client (see server.outbox), so holding the
+// lock for it is cheap.
 func (smgr *sessionManager) broadcast(msg message.Message) {
+    smgr.mu.Lock()
+    defer smgr.mu.Unlock()
+    smgr.broadcastLocked(msg)
+}
+
+// The caller holds mu. The message is only encoded once, however many
+// clients there are.
+func (smgr *sessionManager) broadcastLocked(msg message.Message) {
+    frame := msg.Frame()
+    defer frame.Release()
     for conn := range smgr.clients {
-        err := msg.SendTo(conn)
+        err := frame.SendTo(conn)
         if err != nil {
             addr := conn.RemoteAddr().String()
             err := fmt.Errorf("could not broadcast to %s: %s", addr, err)
@@ -44,22 +213,365 @@ func (smgr *sessionManager) broadcast(msg message.Message) {
     }
 }
 
-func (smgr *sessionManager) verify(sessionKeyHash []byte) bool {
-    return slices.Equal(smgr.sessionKeyHash, sessionKeyHash)
+// The key is checked first, so that only those who know it learn anything
+// more about the session.
+func (smgr *sessionManager) verify(
+    sessionKeyHash []byte,
+    conn net.Conn,
+    ident []byte,
+) (ok bool, reason message.RejReason) {
+    if !smgr.keyMatches(sessionKeyHash) {
+        return false, message.RejKey
+    }
+    smgr.mu.Lock()
+    defer smgr.mu.Unlock()
+    if smgr.bannedLocked(conn) {
+        return false, message.RejBanned
+    }
+    if smgr.locked {
+        return false, message.RejLocked
+    }
+    return true, 0
 }
 
-func (smgr *sessionManager) identify() (idents [][]byte) {
+// argon2id takes 19 MiB a go, and anybody can make the server run it, so only
+// this many run at once. The rest wait their turn.
+const maxHashing = 4
+
+var hashing = make(chan struct{}, maxHashing)
+
+func hashVerifier(verifier []byte, salt []byte) []byte {
+    hashing <- struct{}{}
+    defer func() { <- hashing }()
+    return secure.HashVerifier(verifier, salt)
+}
+
+// Checking against the stored hash is slow on purpose, so it's only done until
+// the first time it matches. Sessions that were never stored durably have no
+// hash, and only ever check the verifier itself.
+func (smgr *sessionManager) keyMatches(sessionKeyHash []byte) bool {
+    smgr.mu.Lock()
+    known := smgr.sessionKeyHash
+    smgr.mu.Unlock()
+    if known != nil || smgr.keyHash == nil {
+        return subtle.ConstantTimeCompare(known, sessionKeyHash) == 1
+    }
+    hash := hashVerifier(sessionKeyHash, smgr.keySalt)
+    if subtle.ConstantTimeCompare(hash, smgr.keyHash) != 1 {
+        return false
+    }
+    smgr.mu.Lock()
+    defer smgr.mu.Unlock()
+    smgr.sessionKeyHash = sessionKeyHash
+    return true
+}
+
+func (smgr *sessionManager) identify() (idents [][]byte, owners [][]byte) {
+    smgr.mu.Lock()
+    defer smgr.mu.Unlock()
     idents = make([][]byte, 0)
-    for _, ident := range smgr.clients {
+    for conn, ident := range smgr.clients {
         idents = append(idents, ident)
+        if smgr.owners[conn] {
+            owners = append(owners, ident)
+        }
+    }
+    return
+}
+
+// The connections of everybody called ident (ignoring case, like
+// identFreeLocked) who is (or isn't) an owner. The caller holds mu.
+func (smgr *sessionManager) membersLocked(
+    ident []byte,
+    owner bool,
+) (conns []net.Conn) {
+    for conn, connIdent := range smgr.clients {
+        if bytes.EqualFold(connIdent, ident) && smgr.owners[conn] == owner {
+            conns = append(conns, conn)
+        }
     }
     return
 }
 
+// The caller holds mu.
+func (smgr *sessionManager) forgetLocked(conn net.Conn) {
+    delete(smgr.clients, conn)
+    delete(smgr.owners, conn)
+    delete(smgr.joined, conn)
+}
+
+// Once the last owner is gone, whoever has been here longest becomes one, so
+// there's always somebody to manage the session. Not in a locked session,
+// though: locking it was the last thing the owners wanted, and whoever owns
+// it can come back with the owner secret. The caller holds mu.
+func (smgr *sessionManager) handoverLocked(
+    sessionID uint16,
+    signingKey ed25519.PrivateKey,
+) (err error) {
+    if len(smgr.owners) > 0 || len(smgr.clients) == 0 || smgr.locked {
+        return
+    }
+    var oldest net.Conn
+    for conn := range smgr.clients {
+        if oldest == nil || smgr.joined[conn] < smgr.joined[oldest] {
+            oldest = conn
+        }
+    }
+    smgr.owners[oldest] = true
+    return smgr.eventLocked(
+        sessionID,
+        signingKey,
+        message.EvtOwner,
+        smgr.clients[oldest],
+    )
+}
+
 func (smgr *sessionManager) getIdent(conn net.Conn) (ident []byte, err error) {
+    smgr.mu.Lock()
+    defer smgr.mu.Unlock()
     if ident, ok := smgr.clients[conn]; ok {
         return ident, nil
     }
     err = fmt.Errorf("conn not in client list")
     return
 }
+
+// Numbers, signs and broadcasts an event. The caller holds mu, which keeps
+// the sequence numbers in the order clients receive them.
+func (smgr *sessionManager) eventLocked(
+    sessionID uint16,
+    signingKey ed25519.PrivateKey,
+    kind message.EvtKind,
+    payload []byte,
+) (err error) {
+    smgr.eventSeq++
+    body := message.EventBody(sessionID, kind, smgr.eventSeq, payload)
+    signature := secure.Sign(signingKey, body)
+    msg, err := message.NewEvent(kind, smgr.eventSeq, payload, signature)
+    if err != nil {
+        return
+    }
+    smgr.broadcastLocked(msg)
+    return
+}
+
+// Makes conn an owner, if the secret is right. Reports whether it wasn't one
+// already.
+func (smgr *sessionManager) claim(
+    conn net.Conn,
+    ownerSecret []byte,
+) (claimed bool, err error) {
+    smgr.mu.Lock()
+    defer smgr.mu.Unlock()
+    if smgr.ownerHash == nil ||
+        subtle.ConstantTimeCompare(secure.Hash(ownerSecret), smgr.ownerHash) != 1 {
+        err = fmt.Errorf("wrong owner secret")
+        return
+    }
+    if _, ok := smgr.clients[conn]; !ok {
+        err = fmt.Errorf("conn not in client list")
+        return
+    }
+    claimed = !smgr.owners[conn]
+    smgr.owners[conn] = true
+    return
+}
+
+// Carries out what an owner asked for, and announces it to everybody
+// (whoever is kicked or banned included, since they're only removed after).
+// Returns the connections that have to be closed, which the caller does
+// without holding mu.
+func (smgr *sessionManager) moderate(
+    sessionID uint16,
+    signingKey ed25519.PrivateKey,
+    conn net.Conn,
+    action message.ModAction,
+    arg []byte,
+) (removed []net.Conn, err error) {
+    smgr.mu.Lock()
+    defer smgr.mu.Unlock()
+    if !smgr.owners[conn] {
+        err = fmt.Errorf("only owners can do that")
+        return
+    }
+    ident := smgr.clients[conn]
+    // Names are matched ignoring case, like idents are kept apart, but
+    // announced as they really are, since that's what clients know them by.
+    switch action {
+    case message.ModKick, message.ModBan:
+        var targetIdent []byte
+        for target, other := range smgr.clients {
+            if bytes.EqualFold(other, arg) {
+                removed = append(removed, target)
+                targetIdent = other
+            }
+        }
+        if len(removed) == 0 {
+            err = fmt.Errorf("nobody called '%s' is here", arg)
+            return
+        }
+        arg = targetIdent
+        kind := message.EvtKick
+        if action == message.ModBan {
+            kind = message.EvtBan
+            var keys []string
+            for _, target := range removed {
+                key, ok := banKey(target)
+                if !ok {
+                    removed = nil
+                    err = fmt.Errorf("can't tell who '%s' is on this socket, kick them instead", arg)
+                    return
+                }
+                keys = append(keys, key)
+            }
+            for _, key := range keys {
+                smgr.banned[key] = true
+            }
+        }
+        if err = smgr.eventLocked(sessionID, signingKey, kind, arg); err != nil {
+            return
+        }
+        for _, target := range removed {
+            smgr.forgetLocked(target)
+        }
+        err = smgr.handoverLocked(sessionID, signingKey)
+    case message.ModPromote:
+        targets := smgr.membersLocked(arg, false)
+        if len(targets) == 0 {
+            err = fmt.Errorf("nobody called '%s' is here who isn't an owner", arg)
+            return
+        }
+        arg = smgr.clients[targets[0]]
+        for _, target := range targets {
+            smgr.owners[target] = true
+        }
+        err = smgr.eventLocked(sessionID, signingKey, message.EvtOwner, arg)
+    case message.ModDemote:
+        targets := smgr.membersLocked(arg, true)
+        if len(targets) == 0 {
+            err = fmt.Errorf("nobody called '%s' is an owner", arg)
+            return
+        }
+        if len(targets) == len(smgr.owners) {
+            err = fmt.Errorf("the session can't be left without an owner")
+            return
+        }
+        arg = smgr.clients[targets[0]]
+        for _, target := range targets {
+            delete(smgr.owners, target)
+        }
+        err = smgr.eventLocked(sessionID, signingKey, message.EvtDemote, arg)
+    case message.ModLock, message.ModUnlock:
+        smgr.locked = action == message.ModLock
+        kind := message.EvtUnlock
+        if smgr.locked {
+            kind = message.EvtLock
+        }
+        err = smgr.eventLocked(sessionID, signingKey, kind, ident)
+    case message.ModApprovalOn, message.ModApprovalOff:
+        smgr.approval = action == message.ModApprovalOn
+        kind := message.EvtApprovalOff
+        if smgr.approval {
+            kind = message.EvtApprovalOn
+        }
+        err = smgr.eventLocked(sessionID, signingKey, kind, ident)
+    case message.ModAdmit, message.ModDeny:
+        waiting, ok := smgr.waitingLocked(arg)
+        if !ok {
+            err = fmt.Errorf("nobody called '%s' is waiting", arg)
+            return
+        }
+        decision := smgr.knocks[waiting]
+        delete(smgr.knocks, waiting)
+        arg = []byte(waiting)
+        decision <- action == message.ModAdmit
+        kind := message.EvtDeny
+        if action == message.ModAdmit {
+            kind = message.EvtAdmit
+        }
+        err = smgr.eventLocked(sessionID, signingKey, kind, arg)
+    default:
+        err = fmt.Errorf("unknown moderation action: %d", action)
+    }
+    return
+}
+
+// Puts a joiner in the waiting room, and lets everybody (the owners in
+// particular) know. The decision comes through the channel, unless nobody
+// makes one; without approval, there's nothing to wait for and it's nil. It's
+// also nil when there's no owner to decide: refusing everybody would lock the
+// session up until it expires, even for its creator, who can only claim it
+// once they're in. Instead, the joiner gets in and takes over.
+func (smgr *sessionManager) knock(
+    sessionID uint16,
+    signingKey ed25519.PrivateKey,
+    ident []byte,
+) (decision chan bool, err error) {
+    smgr.mu.Lock()
+    defer smgr.mu.Unlock()
+    if !smgr.approval || len(smgr.owners) == 0 {
+        return
+    }
+    if err = message.ValidateIdent(ident); err != nil {
+        return
+    }
+    if waiting, ok := smgr.waitingLocked(ident); ok {
+        err = fmt.Errorf("'%s' is already waiting", waiting)
+        return
+    }
+    decision = make(chan bool, 1)
+    err = smgr.eventLocked(sessionID, signingKey, message.EvtKnock, ident)
+    if err != nil {
+        return nil, err
+    }
+    smgr.knocks[string(ident)] = decision
+    return
+}
+
+// Who of those waiting goes by ident, ignoring case. The caller holds mu.
+func (smgr *sessionManager) waitingLocked(ident []byte) (waiting string, ok bool) {
+    for other := range smgr.knocks {
+        if bytes.EqualFold([]byte(other), ident) {
+            return other, true
+        }
+    }
+    return
+}
+
+// Takes a joiner out of the waiting room without a decision, if it's still
+// the same one waiting.
+func (smgr *sessionManager) unknock(ident []byte, decision chan bool) {
+    smgr.mu.Lock()
+    defer smgr.mu.Unlock()
+    if smgr.knocks[string(ident)] == decision {
+        delete(smgr.knocks, string(ident))
+    }
+}
+
+// What a ban holds against a connection: where it comes from, never what it
+// calls itself, since idents (and handles all the more) come and go. That's
+// the host for network listeners, which keeps out everybody sharing it, like
+// those behind the same NAT or proxy. On a Unix socket, where everybody has
+// the same address, it's the user the kernel says is on the other end. ok is
+// false when there's nothing to go on.
+func banKey(conn net.Conn) (key string, ok bool) {
+    addr := conn.RemoteAddr()
+    if addr.Network() == "unix" {
+        uid, found := peerUser(conn)
+        if !found {
+            return
+        }
+        return secure.Fingerprint([]byte("uid:" + uid)), true
+    }
+    host, _, err := net.SplitHostPort(addr.String())
+    if err != nil {
+        host = addr.String()
+    }
+    return secure.Fingerprint([]byte("host:" + host)), true
+}
+
+// The caller holds mu.
+func (smgr *sessionManager) bannedLocked(conn net.Conn) bool {
+    key, ok := banKey(conn)
+    return ok && smgr.banned[key]
+}
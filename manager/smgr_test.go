@@ -0,0 +1,171 @@
+package manager
+
+import (
+	"net"
+	"slices"
+	"testing"
+	"time"
+	"github.com/therekrab/blur/message"
+)
+
+func newTestSession(t *testing.T, mgr *Manager) (id uint16, owner *fakeConn) {
+    t.Helper()
+    id, _, _, err := mgr.NewSession(nil, nil, nil, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    owner = newFakeConn()
+    if _, err = mgr.AddClient(id, []byte("alice"), owner); err != nil {
+        t.Fatal(err)
+    }
+    return
+}
+
+// Idents are kept apart ignoring case, so they're found that way too.
+func TestModerateIgnoresCase(t *testing.T) {
+    mgr := newTestManager(t)
+    id, owner := newTestSession(t, mgr)
+    if _, err := mgr.AddClient(id, []byte("Bob"), newFakeConn()); err != nil {
+        t.Fatal(err)
+    }
+    err := mgr.Moderate(id, owner, message.ModPromote, []byte("bob"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    _, owners, _ := mgr.Identify(id)
+    if !slices.ContainsFunc(owners, func(ident []byte) bool {
+        return string(ident) == "Bob"
+    }) {
+        t.Fatalf("'Bob' wasn't promoted: %q", owners)
+    }
+    err = mgr.Moderate(id, owner, message.ModDemote, []byte("BOB"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    err = mgr.Moderate(id, owner, message.ModKick, []byte("bOB"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    idents, _, _ := mgr.Identify(id)
+    if len(idents) != 1 {
+        t.Fatalf("'Bob' wasn't kicked: %q", idents)
+    }
+}
+
+func TestKnockIgnoresCase(t *testing.T) {
+    mgr := newTestManager(t)
+    id, owner := newTestSession(t, mgr)
+    err := mgr.Moderate(id, owner, message.ModApprovalOn, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    waiting := make(chan struct{})
+    admitted := make(chan bool)
+    go func() {
+        ok, err := mgr.Knock(id, []byte("Bob"), time.Minute, func() error {
+            close(waiting)
+            return nil
+        })
+        if err != nil {
+            t.Error(err)
+        }
+        admitted <- ok
+    }()
+    <- waiting
+    _, err = mgr.Knock(id, []byte("bob"), time.Minute, func() error {
+        return nil
+    })
+    if err == nil {
+        t.Fatal("'bob' got to wait next to 'Bob'")
+    }
+    err = mgr.Moderate(id, owner, message.ModAdmit, []byte("BOB"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !<- admitted {
+        t.Fatal("'Bob' wasn't admitted")
+    }
+}
+
+// A ban holds against where somebody connects from, whatever they call
+// themselves when they come back (a fresh handle included).
+func TestBanHoldsAgainstAddress(t *testing.T) {
+    mgr := newTestManager(t)
+    id, owner := newTestSession(t, mgr)
+    bob := newFakeConn()
+    if _, err := mgr.AddClient(id, []byte("bob"), bob); err != nil {
+        t.Fatal(err)
+    }
+    err := mgr.Moderate(id, owner, message.ModBan, []byte("bob"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    sameHost := &fakeConn{addr: &net.TCPAddr{IP: bob.addr.(*net.TCPAddr).IP, Port: 5050}}
+    otherHost := newFakeConn()
+    cases := []struct {
+        conn *fakeConn
+        ident string
+        banned bool
+    }{
+        {sameHost, "bob", true},
+        {sameHost, "BOB", true},
+        {sameHost, "carol", true},
+        {sameHost, "h-5f3a9c1e", true},
+        {otherHost, "bob", false},
+    }
+    for _, c := range cases {
+        ok, reason := mgr.Verify(id, nil, c.conn, []byte(c.ident))
+        if c.banned != (!ok && reason == message.RejBanned) {
+            t.Errorf("'%s' from %s: ok %t, reason %d", c.ident, c.conn.addr, ok, reason)
+        }
+        _, err := mgr.AddClient(id, []byte(c.ident), c.conn)
+        if c.banned != (err != nil) {
+            t.Errorf("'%s' from %s: %v", c.ident, c.conn.addr, err)
+        }
+        if err == nil {
+            mgr.RemoveClient(id, []byte(c.ident), c.conn)
+        }
+    }
+}
+
+// Without knowing who is on the other end of a Unix socket, a ban could only
+// keep out everybody on it, so it's refused and nobody is removed.
+func TestBanRefusedWithoutPeer(t *testing.T) {
+    mgr := newTestManager(t)
+    id, owner := newTestSession(t, mgr)
+    bob := &fakeConn{addr: &net.UnixAddr{Name: "@", Net: "unix"}}
+    if _, err := mgr.AddClient(id, []byte("bob"), bob); err != nil {
+        t.Fatal(err)
+    }
+    if err := mgr.Moderate(id, owner, message.ModBan, []byte("bob")); err == nil {
+        t.Fatal("banned anyway")
+    }
+    idents, _, err := mgr.Identify(id)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !slices.ContainsFunc(idents, func(ident []byte) bool {
+        return string(ident) == "bob"
+    }) {
+        t.Fatal("'bob' was removed")
+    }
+}
+
+func TestRemoveKicked(t *testing.T) {
+    mgr := newTestManager(t)
+    id, owner := newTestSession(t, mgr)
+    bob := newFakeConn()
+    if _, err := mgr.AddClient(id, []byte("bob"), bob); err != nil {
+        t.Fatal(err)
+    }
+    err := mgr.Moderate(id, owner, message.ModKick, []byte("bob"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if mgr.RemoveClient(id, []byte("bob"), bob) {
+        t.Fatal("'bob' left after being kicked")
+    }
+    if !mgr.RemoveClient(id, []byte("alice"), owner) {
+        t.Fatal("'alice' didn't leave")
+    }
+}
@@ -0,0 +1,82 @@
+package manager
+
+import (
+	"sync"
+	"time"
+)
+
+// SessionRecord is everything about a session that outlives a restart: what
+// it takes to join it and how it behaves. Nothing anybody said in it, nor who
+// was in it, is ever kept.
+type SessionRecord struct {
+    ID uint16 `json:"id"`
+    // What clients derive their keys with, which joiners need to be told.
+    Salt []byte `json:"salt"`
+    // Not what joiners present, but a salted hash of it (see
+    // secure.HashVerifier), so the file alone doesn't make it cheap to guess.
+    KeySalt []byte `json:"keysalt"`
+    KeyHash []byte `json:"keyhash"`
+    Params []byte `json:"params"`
+    TTL time.Duration `json:"ttl"`
+    // Only the hash of the owner secret, and the fingerprints of whoever is
+    // banned.
+    OwnerHash []byte `json:"ownerhash"`
+    Banned []string `json:"banned"`
+    Locked bool `json:"locked"`
+    Approval bool `json:"approval"`
+}
+
+// SessionStore keeps session records for the manager. Save is called whenever
+// a session is made or changes, and Delete once it's gone for good.
+type SessionStore interface {
+    // Every session saved and not deleted since, in no particular order.
+    Load() ([]SessionRecord, error)
+    Save(record SessionRecord) error
+    Delete(sessionID uint16) error
+    Close() error
+    // Whether records outlive the server. Only then are key hashes hashed
+    // again before they're saved.
+    Durable() bool
+}
+
+// Keeps records only for as long as the server runs, which is what the
+// manager uses unless told otherwise.
+type memoryStore struct {
+    mu sync.Mutex
+    records map[uint16]SessionRecord
+}
+
+func NewMemoryStore() SessionStore {
+    return &memoryStore{records: make(map[uint16]SessionRecord)}
+}
+
+func (store *memoryStore) Load() (records []SessionRecord, err error) {
+    store.mu.Lock()
+    defer store.mu.Unlock()
+    for _, record := range store.records {
+        records = append(records, record)
+    }
+    return
+}
+
+func (store *memoryStore) Save(record SessionRecord) (err error) {
+    store.mu.Lock()
+    defer store.mu.Unlock()
+    store.records[record.ID] = record
+    return
+}
+
+func (store *memoryStore) Delete(sessionID uint16) (err error) {
+    store.mu.Lock()
+    defer store.mu.Unlock()
+    delete(store.records, sessionID)
+    return
+}
+
+func (store *memoryStore) Close() (err error) {
+    return
+}
+
+func (store *memoryStore) Durable() bool {
+    return false
+}
@@ -0,0 +1,131 @@
+package manager
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+	"github.com/therekrab/blur/message"
+	"github.com/therekrab/blur/secure"
+)
+
+// What's stored of a session is no help in guessing its key, and still lets
+// those who know it back in after a restart.
+func TestStoreKeepsOnlyKeyHash(t *testing.T) {
+    store, err := OpenFileStore(filepath.Join(t.TempDir(), "sessions"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    mgr := newTestManager(t)
+    if _, err := mgr.SetStore(store); err != nil {
+        t.Fatal(err)
+    }
+    verifier := secure.Hash([]byte("the session key"))
+    salt, err := secure.NewSalt()
+    if err != nil {
+        t.Fatal(err)
+    }
+    id, _, _, err := mgr.NewSession(verifier, salt, nil, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    records, err := store.Load()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(records) != 1 {
+        t.Fatalf("%d records stored", len(records))
+    }
+    record := records[0]
+    if len(record.KeySalt) != secure.SaltSize {
+        t.Fatalf("salt is %d bytes", len(record.KeySalt))
+    }
+    if bytes.Equal(record.KeyHash, verifier) {
+        t.Fatal("stored the verifier as it is")
+    }
+    restored := newTestManager(t)
+    if _, err = restored.SetStore(store); err != nil {
+        t.Fatal(err)
+    }
+    // Joiners still need the salt the key hash was derived with.
+    if kept, err := restored.Salt(id); err != nil || !bytes.Equal(kept, salt) {
+        t.Fatalf("salt not kept: %v", err)
+    }
+    wrong := secure.Hash([]byte("another session key"))
+    // Twice each, since the second check no longer needs the stored hash.
+    for i := 0; i < 2; i++ {
+        if ok, reason := restored.Verify(id, wrong, newFakeConn(), nil); ok {
+            t.Fatal("let in with the wrong key")
+        } else if reason != message.RejKey {
+            t.Fatalf("turned away for %d", reason)
+        }
+        if ok, reason := restored.Verify(id, verifier, newFakeConn(), nil); !ok {
+            t.Fatalf("turned away for %d", reason)
+        }
+    }
+}
+
+// Sessions that only live in memory never need the slow hash, which anybody
+// asking for a new session could otherwise make the server run.
+func TestMemoryStoreSkipsHash(t *testing.T) {
+    mgr := newTestManager(t)
+    verifier := secure.Hash([]byte("the session key"))
+    id, _, _, err := mgr.NewSession(verifier, nil, nil, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    smgr := mgr.getSessionManager(id)
+    if smgr.keySalt != nil || smgr.keyHash != nil {
+        t.Fatal("hashed the verifier anyway")
+    }
+    if ok, _ := mgr.Verify(id, verifier, newFakeConn(), nil); !ok {
+        t.Fatal("turned away with the right key")
+    }
+    wrong := secure.Hash([]byte("another session key"))
+    if ok, _ := mgr.Verify(id, wrong, newFakeConn(), nil); ok {
+        t.Fatal("let in with the wrong key")
+    }
+}
+
+// A session restored from the store gets no more than the server allows now.
+func TestRestoreClampsTTL(t *testing.T) {
+    store := NewMemoryStore()
+    store.Save(SessionRecord{ID: 1, TTL: 24 * time.Hour})
+    mgr := newTestManager(t)
+    mgr.SetMaxTTL(time.Hour)
+    if _, err := mgr.SetStore(store); err != nil {
+        t.Fatal(err)
+    }
+    if ttl := mgr.getSessionManager(1).ttl; ttl != time.Hour {
+        t.Fatalf("restored with a TTL of %s", ttl)
+    }
+}
+
+// Dropping a session takes it out of the store, and its ID can only be handed
+// out again after that.
+func TestDropUnstores(t *testing.T) {
+    store := NewMemoryStore()
+    mgr := newTestManager(t)
+    if _, err := mgr.SetStore(store); err != nil {
+        t.Fatal(err)
+    }
+    id, _, _, err := mgr.NewSession(nil, nil, nil, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    conn := newFakeConn()
+    if _, err = mgr.AddClient(id, []byte("bob"), conn); err != nil {
+        t.Fatal(err)
+    }
+    mgr.RemoveClient(id, []byte("bob"), conn)
+    records, err := store.Load()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(records) != 0 {
+        t.Fatalf("%d records left", len(records))
+    }
+    if sh := mgr.shardFor(id); sh.dropping[id] {
+        t.Fatal("session ID still held back")
+    }
+}
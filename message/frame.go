@@ -0,0 +1,83 @@
+package message
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// Frame is a message already encoded for the wire, in a buffer borrowed from
+// a pool. A broadcast encodes the message once and hands the same Frame to
+// every recipient, each of which holds a reference until it's written. The
+// buffer goes back to the pool when the last reference is released, so
+// nobody may touch Bytes after their Release.
+type Frame struct {
+    buf []byte
+    refs atomic.Int32
+}
+
+var framePool = sync.Pool{
+    New: func() any {
+        // Enough for chat. Bigger messages grow the buffer, which then stays
+        // big in the pool.
+        return &Frame{buf: make([]byte, 0, 512)}
+    },
+}
+
+func newFrame() (frame *Frame) {
+    frame = framePool.Get().(*Frame)
+    frame.buf = frame.buf[:0]
+    frame.refs.Store(1)
+    return
+}
+
+// FrameOf copies an encoded message into a Frame of its own.
+func FrameOf(b []byte) (frame *Frame) {
+    frame = newFrame()
+    frame.buf = append(frame.buf, b...)
+    return
+}
+
+// FrameWriter is a connection that can queue a Frame as it is, instead of
+// having it copied by Write. It takes its own reference if it needs one.
+type FrameWriter interface {
+    WriteFrame(frame *Frame) error
+}
+
+func (frame *Frame) Bytes() []byte {
+    return frame.buf
+}
+
+func (frame *Frame) Retain() {
+    frame.refs.Add(1)
+}
+
+// How many references are held, which only tests should need to know.
+func (frame *Frame) Refs() int32 {
+    return frame.refs.Load()
+}
+
+func (frame *Frame) Release() {
+    if frame.refs.Add(-1) == 0 {
+        framePool.Put(frame)
+    }
+}
+
+// Writes the frame to conn, handing it over whole if conn can take it.
+func (frame *Frame) SendTo(conn net.Conn) (err error) {
+    if writer, ok := conn.(FrameWriter); ok {
+        return writer.WriteFrame(frame)
+    }
+    _, err = conn.Write(frame.buf)
+    return
+}
+
+// Frame encodes the message. The caller owns the only reference to it.
+func (msg *Message) Frame() (frame *Frame) {
+    frame = newFrame()
+    frame.buf = binary.BigEndian.AppendUint16(frame.buf, msg.dsize)
+    frame.buf = append(frame.buf, byte(msg.mtype))
+    frame.buf = append(frame.buf, msg.data...)
+    return
+}
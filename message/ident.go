@@ -0,0 +1,50 @@
+package message
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The longest ident, in characters. Random handles fit comfortably.
+const MaxIdentLength = 32
+
+// Nobody may call themselves one of these, so nobody can pass for the server
+// (or blur itself) in the chat.
+var reservedIdents = []string{"server", "system", "blur"}
+
+// Idents end up on everybody's screen, so they can't be empty, too long, or
+// hold anything but printable characters. In particular, control characters
+// and invisible formatting (like bidi overrides) could make one ident look
+// like another, or mess up the terminal. The same goes for the names behind
+// handles, which only clients get to check.
+func ValidateIdent(ident []byte) (err error) {
+    if !utf8.Valid(ident) {
+        return fmt.Errorf("idents have to be valid UTF-8")
+    }
+    name := string(ident)
+    length := utf8.RuneCountInString(name)
+    if length == 0 || length > MaxIdentLength {
+        return fmt.Errorf(
+            "idents have to be 1 to %d characters long",
+            MaxIdentLength,
+        )
+    }
+    if strings.TrimSpace(name) != name {
+        return fmt.Errorf("idents can't start or end with a space")
+    }
+    for _, r := range name {
+        printable := r == ' ' ||
+            unicode.In(r, unicode.L, unicode.M, unicode.N, unicode.P, unicode.S)
+        if !printable {
+            return fmt.Errorf("idents can't contain %U", r)
+        }
+    }
+    for _, reserved := range reservedIdents {
+        if strings.EqualFold(name, reserved) {
+            return fmt.Errorf("'%s' is reserved", name)
+        }
+    }
+    return
+}
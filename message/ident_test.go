@@ -0,0 +1,35 @@
+package message
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateIdent(t *testing.T) {
+    cases := map[string]bool{
+        "bob": true,
+        "Bob the Builder": true,
+        "zoë": true,
+        "李雷": true,
+        "émile-2": true,
+        strings.Repeat("a", MaxIdentLength): true,
+        "": false,
+        strings.Repeat("a", MaxIdentLength + 1): false,
+        " bob": false,
+        "bob ": false,
+        "bob\n": false,
+        "bo\x1bb": false,
+        "bob‮": false,
+        "bo​b": false,
+        "\xff": false,
+        "server": false,
+        "SYSTEM": false,
+        "Blur": false,
+    }
+    for ident, valid := range cases {
+        err := ValidateIdent([]byte(ident))
+        if valid != (err == nil) {
+            t.Errorf("%q: %v", ident, err)
+        }
+    }
+}
@@ -3,6 +3,7 @@ package message
 import (
 	"encoding/binary"
 	"fmt"
+	"io"
 	"math"
 	"net"
 )
@@ -29,21 +30,10 @@ func NewMessage(dsize uint16, mtype MType, data []byte) (msg Message) {
     return Message{dsize, mtype, data} 
 }
 
-func (msg *Message) bytes() []byte {
-    msgBytes := make([]byte, 2)
-    binary.BigEndian.PutUint16(msgBytes, msg.dsize)
-    msgBytes = append(msgBytes, byte(msg.mtype))
-    msgBytes = append(msgBytes, msg.data...)
-    return msgBytes
-}
-
 func (msg *Message) SendTo(conn net.Conn) (err error) {
-    msgBytes := msg.bytes()
-    _, err = conn.Write(msgBytes)
-    if err != nil {
-        return err
-    }
-    return
+    frame := msg.Frame()
+    defer frame.Release()
+    return frame.SendTo(conn)
 }
 
 func NewChat(data []byte) (msg Message, err error) {
@@ -60,12 +50,35 @@ func NewServerChat(source []byte, data []byte) (msg Message, err error) {
     if err != nil {
         return
     }
-    msg = msg.PrependSource(source)
-    return
+    return msg.PrependSource(source)
 }
 
 func NewIdent(idents [][]byte) (msg Message, err error) {
-    data := make([]byte, 0)
+    data := appendIdents(nil, idents)
+    msg = NewMessage(uint16(len(data)), IDENT, data)
+    return
+}
+
+// Like NewIdent, but followed by a second list: who of them are owners.
+// Anybody only reading the first list never notices.
+func NewRoster(idents [][]byte, owners [][]byte) (msg Message, err error) {
+    data := appendIdents(nil, idents)
+    data = appendIdents(data, owners)
+    if len(data) > math.MaxUint16 {
+        err = fmt.Errorf("roster was too large")
+        return
+    }
+    msg = NewMessage(uint16(len(data)), IDENT, data)
+    return
+}
+
+// The payload of a rename event: the old ident and the new one, listed like
+// in an IDENT.
+func RenamePayload(oldIdent []byte, newIdent []byte) []byte {
+    return appendIdents(nil, [][]byte{oldIdent, newIdent})
+}
+
+func appendIdents(data []byte, idents [][]byte) []byte {
     for _, ident := range idents {
         dsize := uint16(len(ident))
         dsizeBytes := make([]byte, 2)
@@ -74,57 +87,118 @@ func NewIdent(idents [][]byte) (msg Message, err error) {
         data = append(data, ident...)
     }
     terminator := make([]byte, 2, 2)
-    data = append(data, terminator...)
-    msg = NewMessage(uint16(len(data)), IDENT, data)
+    return append(data, terminator...)
+}
+
+// The new group key for one member, sealed to their public key. Recipient is
+// the SHA256 hash of that key, since hybrid public keys are rather long.
+type RekeyEntry struct {
+    Recipient []byte
+    Sealed []byte
+}
+
+type Rekey struct {
+    Epoch uint32
+    Sender []byte
+    Entries []RekeyEntry
+}
+
+// Encodes everything in a REKEY message except the MAC, which the client adds
+// once it knows what it is signing.
+func (rekey *Rekey) Bytes() []byte {
+    data := make([]byte, 4)
+    binary.BigEndian.PutUint32(data, rekey.Epoch)
+    data = append(data, rekey.Sender...)
+    data = binary.BigEndian.AppendUint16(data, uint16(len(rekey.Entries)))
+    for _, entry := range rekey.Entries {
+        data = append(data, entry.Recipient...)
+        data = binary.BigEndian.AppendUint16(data, uint16(len(entry.Sealed)))
+        data = append(data, entry.Sealed...)
+    }
+    return data
+}
+
+// EventBody is what the server signs for an event: the session it happened
+// in, its kind, its sequence number within the session, and its payload.
+func EventBody(
+    sessionID uint16,
+    kind EvtKind,
+    seq uint64,
+    payload []byte,
+) (body []byte) {
+    body = []byte("blur event")
+    body = binary.BigEndian.AppendUint16(body, sessionID)
+    body = append(body, byte(kind))
+    body = binary.BigEndian.AppendUint64(body, seq)
+    body = append(body, payload...)
+    return
+}
+
+func NewEvent(
+    kind EvtKind,
+    seq uint64,
+    payload []byte,
+    signature []byte,
+) (msg Message, err error) {
+    data := []byte{byte(kind)}
+    data = binary.BigEndian.AppendUint64(data, seq)
+    data = append(data, payload...)
+    data = append(data, signature...)
+    if len(data) > math.MaxUint16 {
+        err = fmt.Errorf("event was too large")
+        return
+    }
+    msg = NewMessage(uint16(len(data)), EVT, data)
     return
 }
 
+// A single Read may return less than a whole message (TLS hands data over one
+// record at a time), so every part is read in full.
 func ReadMessage(conn net.Conn) (msg Message, err error) {
     dsizeBytes := make([]byte, 2)
-    n, err := conn.Read(dsizeBytes)
+    _, err = io.ReadFull(conn, dsizeBytes)
     if err != nil {
         return
     }
-    if n != 2 {
-        err = fmt.Errorf("could not read DSIZE")
-        return
-    }
     dsize := binary.BigEndian.Uint16(dsizeBytes)
     mtypeBytes := make([]byte, 1)
-    n, err = conn.Read(mtypeBytes)
-    if err != nil {
-        return
-    }
-    if n != 1 {
+    _, err = io.ReadFull(conn, mtypeBytes)
+    if err == io.EOF {
         err = fmt.Errorf("could not read MTYPE")
+    }
+    if err != nil {
         return
     }
     mtype := MType(mtypeBytes[0])
     data := make([]byte, dsize)
-    n, err = conn.Read(data)
+    n, err := io.ReadFull(conn, data)
     if err != nil {
-        return
-    }
-    if uint16(n) != dsize {
         err = fmt.Errorf(
             "could not read DATA: expected %d bytes, got %d.",
             dsize,
             n,
         )
+        return
     }
     msg = NewMessage(dsize, mtype, data)
     return
 
 }
 
-func (msg *Message) PrependSource(ident []byte) (alteredMsg Message) {
-    miniDsize := uint16(len(ident))
-    alteredDsize := msg.dsize + miniDsize + 2 // 2 for the size of miniDsize.
-    miniDsizeBytes := make([]byte, 2)
-    binary.BigEndian.PutUint16(miniDsizeBytes, miniDsize)
-    miniData := append(miniDsizeBytes, ident...)
-    alteredData := append(miniData, msg.data...)
-    alteredMsg = NewMessage(alteredDsize, msg.mtype, alteredData)
+// Relayed messages grow by the source's ident, which can push a message that
+// only just fit past what DSIZE can describe. Those are refused rather than
+// sent with a size that wrapped around.
+func (msg *Message) PrependSource(ident []byte) (alteredMsg Message, err error) {
+    size := int(msg.dsize) + len(ident) + 2 // 2 for the size of the ident.
+    if size > math.MaxUint16 {
+        err = fmt.Errorf("message was too large to relay")
+        return
+    }
+    // Sized up front, so relaying costs a single allocation.
+    alteredData := make([]byte, 0, size)
+    alteredData = binary.BigEndian.AppendUint16(alteredData, uint16(len(ident)))
+    alteredData = append(alteredData, ident...)
+    alteredData = append(alteredData, msg.data...)
+    alteredMsg = NewMessage(uint16(size), msg.mtype, alteredData)
     return
 }
-
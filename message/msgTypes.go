@@ -12,4 +12,64 @@ type MType byte
     IDENT
     CHT
     CHTE
+    KEYR
+    KEY
+    REKEY
+    EVT
+    SRVKEY
+    OWN
+    MOD
+    ERR
+    WAIT
+    NAME
+    SALTR
+    SALT
+)
+
+// What an EVT message is announcing.
+type EvtKind byte
+
+const (
+    EvtJoin EvtKind = iota
+    EvtLeave
+    EvtOwner
+    EvtKick
+    EvtBan
+    EvtLock
+    EvtUnlock
+    EvtKnock
+    EvtAdmit
+    EvtDeny
+    EvtApprovalOn
+    EvtApprovalOff
+    EvtDemote
+    EvtRename
+)
+
+// What an owner asks for in a MOD message.
+type ModAction byte
+
+const (
+    ModKick ModAction = iota
+    ModBan
+    ModLock
+    ModUnlock
+    ModApprovalOn
+    ModApprovalOff
+    ModAdmit
+    ModDeny
+    ModPromote
+    ModDemote
+)
+
+// Why a JOIN? was turned down, in the REJ.
+type RejReason byte
+
+const (
+    RejSession RejReason = iota
+    RejKey
+    RejLocked
+    RejBanned
+    // Turned away from the waiting room, or left waiting for too long.
+    RejDenied
 )
@@ -0,0 +1,132 @@
+package message
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net"
+	"testing"
+)
+
+// A connection that throws away whatever is written to it.
+type discard struct {
+    net.Conn
+}
+
+func (discard) Write(b []byte) (int, error) {
+    return len(b), nil
+}
+
+func TestPrependSource(t *testing.T) {
+    msg := NewMessage(3, CHTE, []byte("abc"))
+    altered, err := msg.PrependSource([]byte("bob"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if altered.DSize() != 8 || altered.MType() != CHTE {
+        t.Fatalf("got dsize %d, mtype %d", altered.DSize(), altered.MType())
+    }
+    source, data, err := ParseCht(altered.Data())
+    if err != nil {
+        t.Fatal(err)
+    }
+    if string(source) != "bob" || string(data) != "abc" {
+        t.Fatalf("got '%s' from '%s'", data, source)
+    }
+}
+
+// Anything that wouldn't fit in DSIZE anymore once the ident is in front is
+// refused, instead of having its size wrap around.
+func TestPrependSourceTooLarge(t *testing.T) {
+    ident := []byte("bob")
+    fits := math.MaxUint16 - len(ident) - 2
+    for _, size := range []int{fits, fits + 1, math.MaxUint16} {
+        msg := NewMessage(uint16(size), CHTE, make([]byte, size))
+        altered, err := msg.PrependSource(ident)
+        if size > fits {
+            if err == nil {
+                t.Errorf("%d bytes: relayed with dsize %d", size, altered.DSize())
+            }
+            continue
+        }
+        if err != nil {
+            t.Fatalf("%d bytes: %s", size, err)
+        }
+        if altered.DSize() != math.MaxUint16 {
+            t.Errorf("%d bytes: got dsize %d", size, altered.DSize())
+        }
+    }
+}
+
+func TestFrame(t *testing.T) {
+    msg := NewMessage(3, CHT, []byte("abc"))
+    frame := msg.Frame()
+    defer frame.Release()
+    want := []byte{0, 3, byte(CHT), 'a', 'b', 'c'}
+    if !bytes.Equal(frame.Bytes(), want) {
+        t.Fatalf("got %v, want %v", frame.Bytes(), want)
+    }
+}
+
+// How messages were encoded before frames: a new buffer every time, grown as
+// it goes.
+func encode(msg *Message) []byte {
+    msgBytes := make([]byte, 2)
+    binary.BigEndian.PutUint16(msgBytes, msg.dsize)
+    msgBytes = append(msgBytes, byte(msg.mtype))
+    msgBytes = append(msgBytes, msg.data...)
+    return msgBytes
+}
+
+// How sources were prepended before.
+func prepend(msg *Message, ident []byte) Message {
+    miniDsizeBytes := make([]byte, 2)
+    binary.BigEndian.PutUint16(miniDsizeBytes, uint16(len(ident)))
+    miniData := append(miniDsizeBytes, ident...)
+    alteredData := append(miniData, msg.data...)
+    return NewMessage(uint16(len(alteredData)), msg.mtype, alteredData)
+}
+
+const recipients = 16
+
+func BenchmarkBroadcast(b *testing.B) {
+    msg := NewMessage(200, CHTE, make([]byte, 200))
+    var conn net.Conn = discard{}
+    b.Run("frame", func(b *testing.B) {
+        b.ReportAllocs()
+        for i := 0; i < b.N; i++ {
+            frame := msg.Frame()
+            for j := 0; j < recipients; j++ {
+                frame.Retain()
+                frame.SendTo(conn)
+                frame.Release()
+            }
+            frame.Release()
+        }
+    })
+    b.Run("encode-each", func(b *testing.B) {
+        b.ReportAllocs()
+        for i := 0; i < b.N; i++ {
+            for j := 0; j < recipients; j++ {
+                conn.Write(encode(&msg))
+            }
+        }
+    })
+}
+
+func BenchmarkPrependSource(b *testing.B) {
+    msg := NewMessage(200, CHTE, make([]byte, 200))
+    ident := []byte("somebody")
+    b.Run("sized", func(b *testing.B) {
+        b.ReportAllocs()
+        for i := 0; i < b.N; i++ {
+            msg.PrependSource(ident)
+        }
+    })
+    b.Run("appended", func(b *testing.B) {
+        b.ReportAllocs()
+        for i := 0; i < b.N; i++ {
+            prepend(&msg, ident)
+        }
+    })
+}
@@ -1,20 +1,108 @@
 package message
 
 import (
+	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
+	"time"
 )
 
-func ParseJoin(data []byte) (sessionID uint16, sessionKeyHash []byte) {
+// A JOIN? request is the session ID, the key hash, and optionally the ident
+// the client will identify as, for sessions that ask owners who to let in.
+func ParseJoin(
+    data []byte,
+) (sessionID uint16, sessionKeyHash []byte, ident []byte, err error) {
+    if len(data) < 2 + sha256.Size {
+        err = fmt.Errorf("JOIN? DATA too short")
+        return
+    }
     sessionIDBytes := data[:2] // First two bytes
-    sessionKeyHash = data[2:]
+    sessionKeyHash = data[2:2 + sha256.Size]
+    ident = data[2 + sha256.Size:]
     sessionID = binary.BigEndian.Uint16(sessionIDBytes)
     return
 }
 
+// The first 32 bytes of a NEW? request are the key hash, then the saltSize
+// byte salt it was derived with, followed by how many seconds the session
+// should outlive its last member. Anything after that is session parameters,
+// which only clients interpret.
+func ParseNew(
+    data []byte,
+    saltSize int,
+) (
+    sessionKeyHash []byte,
+    salt []byte,
+    ttl time.Duration,
+    params []byte,
+    err error,
+) {
+    if len(data) < sha256.Size + saltSize + 4 {
+        err = fmt.Errorf("NEW? DATA too short")
+        return
+    }
+    sessionKeyHash = data[:sha256.Size]
+    salt = data[sha256.Size:sha256.Size + saltSize]
+    data = data[sha256.Size + saltSize:]
+    seconds := binary.BigEndian.Uint32(data[:4])
+    ttl = time.Duration(seconds) * time.Second
+    params = data[4:]
+    return
+}
+
+// The session ID, how long the session outlives its last member (zero if the
+// server didn't say), and the secret that makes whoever knows it an owner (if
+// the server gave one).
+func ParseNewResponse(
+    data []byte,
+) (sessionID uint16, ttl time.Duration, ownerSecret []byte, err error) {
+    if len(data) < 2 {
+        err = fmt.Errorf("NEW DATA too short")
+        return
+    }
+    sessionID = binary.BigEndian.Uint16(data)
+    if len(data) >= 6 {
+        seconds := binary.BigEndian.Uint32(data[2:6])
+        ttl = time.Duration(seconds) * time.Second
+    }
+    if len(data) > 6 {
+        ownerSecret = data[6:]
+    }
+    return
+}
+
+// A SALT? request is only the session ID.
+func ParseSaltR(data []byte) (sessionID uint16, err error) {
+    if len(data) != 2 {
+        err = fmt.Errorf("SALT? DATA has the wrong size")
+        return
+    }
+    sessionID = binary.BigEndian.Uint16(data)
+    return
+}
+
 func ParseIdent(data []byte) (idents [][]byte, err error) {
+    idents, _, err = parseIdents(data)
+    return
+}
+
+// Parses an IDENT from the server, which may list the owners after everybody
+// in the session.
+func ParseRoster(data []byte) (idents [][]byte, owners [][]byte, err error) {
+    idents, n, err := parseIdents(data)
+    if err != nil {
+        return
+    }
+    owners, _, err = parseIdents(data[n:])
+    return
+}
+
+// Parses one list of idents, up to and including its terminator. n is how
+// many bytes that took.
+func parseIdents(data []byte) (idents [][]byte, n int, err error) {
     idents = make([][]byte, 0)
     i := 0
+    defer func() { n = i }()
     for i < len(data) {
         // Read two bytes!
         if i + 2 > len(data) {
@@ -56,3 +144,96 @@ func ParseCht(data []byte) (source []byte, cht []byte, err error) {
     cht = data[2+dsize:]
     return
 }
+
+func ParseKey(
+    data []byte,
+    pubSize int,
+) (recipient []byte, sender []byte, epoch uint32, sealed []byte, err error) {
+    if len(data) < 2 * pubSize + 4 {
+        err = fmt.Errorf("KEY DATA too short")
+        return
+    }
+    recipient = data[:pubSize]
+    sender = data[pubSize:2*pubSize]
+    epoch = binary.BigEndian.Uint32(data[2*pubSize:2*pubSize+4])
+    sealed = data[2*pubSize+4:]
+    return
+}
+
+// Parses a REKEY body. Entries name their recipient by the SHA256 hash of
+// their public key. The last macSize bytes are the MAC, and signed is
+// everything it covers.
+func ParseRekey(
+    data []byte,
+    pubSize int,
+    macSize int,
+) (rekey Rekey, mac []byte, signed []byte, err error) {
+    if len(data) < 4 + pubSize + 2 + macSize {
+        err = fmt.Errorf("REKEY DATA too short")
+        return
+    }
+    signed = data[:len(data)-macSize]
+    mac = data[len(data)-macSize:]
+    rekey.Epoch = binary.BigEndian.Uint32(signed[:4])
+    rekey.Sender = signed[4:4+pubSize]
+    count := int(binary.BigEndian.Uint16(signed[4+pubSize:6+pubSize]))
+    i := 6 + pubSize
+    for range count {
+        if i + sha256.Size + 2 > len(signed) {
+            err = fmt.Errorf("invalid REKEY entry")
+            return
+        }
+        recipient := signed[i:i+sha256.Size]
+        i += sha256.Size
+        sealedSize := int(binary.BigEndian.Uint16(signed[i:i+2]))
+        i += 2
+        if i + sealedSize > len(signed) {
+            err = fmt.Errorf("invalid REKEY entry")
+            return
+        }
+        rekey.Entries = append(rekey.Entries, RekeyEntry{
+            Recipient: recipient,
+            Sealed: signed[i:i+sealedSize],
+        })
+        i += sealedSize
+    }
+    return
+}
+
+func ParseEvent(
+    data []byte,
+    sigSize int,
+) (kind EvtKind, seq uint64, payload []byte, signature []byte, err error) {
+    if len(data) < 9 + sigSize {
+        err = fmt.Errorf("EVT DATA too short")
+        return
+    }
+    kind = EvtKind(data[0])
+    seq = binary.BigEndian.Uint64(data[1:9])
+    payload = data[9:len(data)-sigSize]
+    signature = data[len(data)-sigSize:]
+    return
+}
+
+func ParseRename(payload []byte) (oldIdent []byte, newIdent []byte, err error) {
+    idents, err := ParseIdent(payload)
+    if err != nil {
+        return
+    }
+    if len(idents) != 2 {
+        err = fmt.Errorf("funny rename: wanted 2 idents, got %d", len(idents))
+        return
+    }
+    return idents[0], idents[1], nil
+}
+
+// A MOD message is the action, followed by whatever it applies to.
+func ParseMod(data []byte) (action ModAction, arg []byte, err error) {
+    if len(data) < 1 {
+        err = fmt.Errorf("MOD DATA too short")
+        return
+    }
+    action = ModAction(data[0])
+    arg = data[1:]
+    return
+}
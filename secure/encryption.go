@@ -4,19 +4,49 @@ import (
     "crypto/rand"
     "crypto/cipher"
     "crypto/aes"
+    "crypto/sha256"
+    "fmt"
+    "io"
+
+    "golang.org/x/crypto/argon2"
+    "golang.org/x/crypto/hkdf"
 )
 
 const KEYSIZE int = 32
 
-func GenKey(key string) (validKey []byte) {
-    if len(key) == 0 {
-        return make([]byte, KEYSIZE, KEYSIZE)
+// A session key is stretched with argon2id (the second set of parameters RFC
+// 9106 recommends) and the session's salt, so every guess at it costs the same
+// to whoever makes it, the server included. The auth key and the verifier the
+// server checks are then drawn from that under labels of their own, so
+// knowing the verifier says nothing about the auth key.
+func DeriveSessionKeys(
+    sessionKey []byte,
+    salt []byte,
+) (authKey []byte, verifier []byte, err error) {
+    if len(salt) != SaltSize {
+        err = fmt.Errorf("session salt has the wrong size")
+        return
     }
-    if len(key) >= KEYSIZE {
-        validKey = []byte(key[:KEYSIZE])
+    base := argon2.IDKey(
+        sessionKey,
+        salt,
+        3,
+        64 * 1024,
+        4,
+        uint32(KEYSIZE),
+    )
+    defer Zero(base)
+    if authKey, err = expand(base, "blur auth key"); err != nil {
         return
     }
-    return GenKey(key + key)
+    verifier, err = expand(base, "blur verifier")
+    return
+}
+
+func expand(base []byte, label string) (key []byte, err error) {
+    key = make([]byte, KEYSIZE)
+    _, err = io.ReadFull(hkdf.New(sha256.New, base, nil, []byte(label)), key)
+    return
 }
 
 func BuildAesGCM(key []byte) (aesGCM cipher.AEAD, err error){
@@ -32,21 +62,36 @@ func BuildAesGCM(key []byte) (aesGCM cipher.AEAD, err error){
 }
 
 
-func EncryptData(aesGCM cipher.AEAD, data []byte) (out []byte, err error) {
+// The data is padded first, then sealed with a random nonce as long as
+// whatever the suite behind aead wants. The nonce is sent ahead of the
+// encrypted data.
+func EncryptData(
+    aead cipher.AEAD,
+    data []byte,
+    padding Padding,
+) (out []byte, err error) {
     // Generate a nonce
-    nonce := make([]byte, 12)
+    nonce := make([]byte, aead.NonceSize())
     if _, err := rand.Read(nonce); err != nil {
         return nil, err
     }
     // actually do some encrypting.
-    encrypted := aesGCM.Seal(nil, nonce, data, nil)
+    encrypted := aead.Seal(nil, nonce, padding.Pad(data), nil)
     out = append(nonce, encrypted...)
     return
 }
 
-func DecryptData(aesGCM cipher.AEAD, data []byte) (out []byte, err error) {
-    nonce := data[:12]
-    encryptedData := data[12:]
+func DecryptData(aead cipher.AEAD, data []byte) (out []byte, err error) {
+    nonceSize := aead.NonceSize()
+    if len(data) < nonceSize {
+        return nil, fmt.Errorf("encrypted data too short")
+    }
+    nonce := data[:nonceSize]
+    encryptedData := data[nonceSize:]
     // now decrypt it!
-    return aesGCM.Open(nil, nonce, encryptedData, nil)
+    padded, err := aead.Open(nil, nonce, encryptedData, nil)
+    if err != nil {
+        return
+    }
+    return Unpad(padded)
 }
@@ -0,0 +1,50 @@
+package secure
+
+import (
+	"bytes"
+	"testing"
+)
+
+// The server holds the verifier, so it must not lead anywhere near the auth
+// key, and neither may come out the same for another salt.
+func TestDeriveSessionKeys(t *testing.T) {
+    salt := count(0x00, SaltSize)
+    authKey, verifier, err := DeriveSessionKeys([]byte("passphrase"), salt)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(authKey) != KEYSIZE || len(verifier) != KEYSIZE {
+        t.Fatalf("got %d and %d bytes", len(authKey), len(verifier))
+    }
+    if bytes.Equal(authKey, verifier) {
+        t.Error("auth key and verifier are the same")
+    }
+    again, _, err := DeriveSessionKeys([]byte("passphrase"), salt)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Equal(again, authKey) {
+        t.Error("same passphrase and salt, different auth key")
+    }
+    otherAuthKey, otherVerifier, err := DeriveSessionKeys(
+        []byte("passphrase"),
+        count(0x01, SaltSize),
+    )
+    if err != nil {
+        t.Fatal(err)
+    }
+    if bytes.Equal(otherAuthKey, authKey) || bytes.Equal(otherVerifier, verifier) {
+        t.Error("another salt made no difference")
+    }
+    // No passphrase at all still gets a real key.
+    empty, _, err := DeriveSessionKeys(nil, salt)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if bytes.Equal(empty, make([]byte, KEYSIZE)) {
+        t.Error("empty passphrase gave a key of zeros")
+    }
+    if _, _, err = DeriveSessionKeys([]byte("passphrase"), salt[1:]); err == nil {
+        t.Error("short salt accepted")
+    }
+}
@@ -0,0 +1,278 @@
+package secure
+
+import (
+	"crypto/ecdh"
+	"crypto/mlkem"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// KeyExchange selects how a session's group key is established.
+type KeyExchange byte
+
+const (
+    // The group key is derived directly from the passphrase.
+    Passphrase KeyExchange = iota
+    // The creator generates a random group key and hands it to each joiner
+    // sealed to an ephemeral X25519 key. The passphrase only authenticates.
+    X25519
+    // Like X25519, but every key is sealed with both X25519 and ML-KEM-768.
+    // Recording the traffic today and breaking X25519 later is not enough to
+    // open it.
+    X25519MLKEM768
+)
+
+const x25519Size int = 32
+
+func ParseKeyExchange(name string) (kx KeyExchange, err error) {
+    switch name {
+    case "", "passphrase":
+        kx = Passphrase
+    case "x25519":
+        kx = X25519
+    case "x25519-mlkem768", "hybrid":
+        kx = X25519MLKEM768
+    default:
+        err = fmt.Errorf("unknown key exchange: %s", name)
+    }
+    return
+}
+
+func (kx KeyExchange) String() string {
+    switch kx {
+    case Passphrase:
+        return "passphrase"
+    case X25519:
+        return "x25519"
+    case X25519MLKEM768:
+        return "x25519-mlkem768"
+    }
+    return fmt.Sprintf("unknown (%d)", byte(kx))
+}
+
+// How long a public key is: the X25519 key, followed by the ML-KEM-768
+// encapsulation key for hybrid exchanges.
+func (kx KeyExchange) PublicSize() int {
+    if kx == X25519MLKEM768 {
+        return x25519Size + mlkem.EncapsulationKeySize768
+    }
+    return x25519Size
+}
+
+// How long the ciphertext from Encapsulate is: an ephemeral X25519 key,
+// followed by the ML-KEM-768 ciphertext for hybrid exchanges.
+func (kx KeyExchange) CiphertextSize() int {
+    if kx == X25519MLKEM768 {
+        return x25519Size + mlkem.CiphertextSize768
+    }
+    return x25519Size
+}
+
+type KeyPair struct {
+    kx KeyExchange
+    private *ecdh.PrivateKey
+    decapsulation *mlkem.DecapsulationKey768
+}
+
+func GenKeyPair(kx KeyExchange) (kp KeyPair, err error) {
+    kp.kx = kx
+    kp.private, err = ecdh.X25519().GenerateKey(rand.Reader)
+    if err != nil {
+        return
+    }
+    if kx == X25519MLKEM768 {
+        kp.decapsulation, err = mlkem.GenerateKey768()
+    }
+    return
+}
+
+// Wipe drops the private keys, and the pair can't be used after that.
+// crypto/ecdh and crypto/mlkem keep their keys out of reach, so they can't be
+// zeroed in place; dropping the only references to them (and never reusing
+// the pair) is as close as we get.
+func (kp *KeyPair) Wipe() {
+    kp.private = nil
+    kp.decapsulation = nil
+}
+
+// A wiped pair has no public key either.
+func (kp *KeyPair) Public() []byte {
+    if kp.private == nil {
+        return nil
+    }
+    pub := kp.private.PublicKey().Bytes()
+    if kp.decapsulation != nil {
+        pub = append(pub, kp.decapsulation.EncapsulationKey().Bytes()...)
+    }
+    return pub
+}
+
+func NewGroupKey() (key []byte, err error) {
+    key = make([]byte, KEYSIZE)
+    _, err = rand.Read(key)
+    return
+}
+
+// CombineHybrid feeds both shared secrets through HKDF, along with the X25519
+// half of the ciphertext and the recipient's X25519 key. The result is secret
+// as long as either one of the two shared secrets is.
+func CombineHybrid(
+    mlkemShared []byte,
+    x25519Shared []byte,
+    x25519Ciphertext []byte,
+    x25519Public []byte,
+) (shared []byte, err error) {
+    secret := append([]byte{}, mlkemShared...)
+    secret = append(secret, x25519Shared...)
+    info := []byte("blur x25519-mlkem768")
+    info = append(info, x25519Ciphertext...)
+    info = append(info, x25519Public...)
+    shared = make([]byte, KEYSIZE)
+    _, err = io.ReadFull(hkdf.New(sha256.New, secret, nil, info), shared)
+    return
+}
+
+// Encapsulate makes a fresh shared secret that only the holder of the private
+// half of recipient can recover from ciphertext.
+func (kx KeyExchange) Encapsulate(
+    recipient []byte,
+) (ciphertext []byte, shared []byte, err error) {
+    if len(recipient) != kx.PublicSize() {
+        err = fmt.Errorf("public key has the wrong size for %s", kx)
+        return
+    }
+    recipientKey, err := ecdh.X25519().NewPublicKey(recipient[:x25519Size])
+    if err != nil {
+        return
+    }
+    ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+    if err != nil {
+        return
+    }
+    shared, err = ephemeral.ECDH(recipientKey)
+    if err != nil {
+        return
+    }
+    ciphertext = ephemeral.PublicKey().Bytes()
+    if kx != X25519MLKEM768 {
+        return
+    }
+    encapsulation, err := mlkem.NewEncapsulationKey768(recipient[x25519Size:])
+    if err != nil {
+        return
+    }
+    mlkemShared, mlkemCiphertext := encapsulation.Encapsulate()
+    shared, err = CombineHybrid(
+        mlkemShared,
+        shared,
+        ciphertext,
+        recipient[:x25519Size],
+    )
+    ciphertext = append(ciphertext, mlkemCiphertext...)
+    return
+}
+
+func (kp *KeyPair) Decapsulate(ciphertext []byte) (shared []byte, err error) {
+    if kp.private == nil {
+        err = fmt.Errorf("key pair was wiped")
+        return
+    }
+    if len(ciphertext) != kp.kx.CiphertextSize() {
+        err = fmt.Errorf("ciphertext has the wrong size for %s", kp.kx)
+        return
+    }
+    ephemeral, err := ecdh.X25519().NewPublicKey(ciphertext[:x25519Size])
+    if err != nil {
+        return
+    }
+    shared, err = kp.private.ECDH(ephemeral)
+    if err != nil || kp.kx != X25519MLKEM768 {
+        return
+    }
+    mlkemShared, err := kp.decapsulation.Decapsulate(ciphertext[x25519Size:])
+    if err != nil {
+        return
+    }
+    return CombineHybrid(
+        mlkemShared,
+        shared,
+        ciphertext[:x25519Size],
+        kp.private.PublicKey().Bytes(),
+    )
+}
+
+// Both sides feed the passphrase key in as the HKDF salt, so somebody who only
+// sees (or swaps) the public keys still can't derive the wrapping key.
+func wrapKey(
+    shared []byte,
+    authKey []byte,
+    ciphertext []byte,
+    recipient []byte,
+) (key []byte, err error) {
+    info := []byte("blur group key")
+    info = append(info, ciphertext...)
+    info = append(info, recipient...)
+    key = make([]byte, KEYSIZE)
+    _, err = io.ReadFull(hkdf.New(sha256.New, shared, authKey, info), key)
+    return
+}
+
+// SealKey encrypts secret with suite so that only the holder of the private
+// half of recipient (who also knows authKey) can open it. The result is the
+// ciphertext from Encapsulate followed by the encrypted secret.
+func SealKey(
+    kx KeyExchange,
+    suite Suite,
+    recipient []byte,
+    authKey []byte,
+    secret []byte,
+) (sealed []byte, err error) {
+    ciphertext, shared, err := kx.Encapsulate(recipient)
+    if err != nil {
+        return
+    }
+    key, err := wrapKey(shared, authKey, ciphertext, recipient)
+    if err != nil {
+        return
+    }
+    aead, err := suite.NewAEAD(key)
+    if err != nil {
+        return
+    }
+    encrypted, err := EncryptData(aead, secret, NoPadding)
+    if err != nil {
+        return
+    }
+    sealed = append(ciphertext, encrypted...)
+    return
+}
+
+func (kp *KeyPair) OpenKey(
+    suite Suite,
+    authKey []byte,
+    sealed []byte,
+) (secret []byte, err error) {
+    ciphertextSize := kp.kx.CiphertextSize()
+    if len(sealed) < ciphertextSize {
+        err = fmt.Errorf("sealed key too short")
+        return
+    }
+    ciphertext := sealed[:ciphertextSize]
+    shared, err := kp.Decapsulate(ciphertext)
+    if err != nil {
+        return
+    }
+    key, err := wrapKey(shared, authKey, ciphertext, kp.Public())
+    if err != nil {
+        return
+    }
+    aead, err := suite.NewAEAD(key)
+    if err != nil {
+        return
+    }
+    return DecryptData(aead, sealed[ciphertextSize:])
+}
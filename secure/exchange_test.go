@@ -0,0 +1,280 @@
+package secure
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"testing"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+func unhex(t *testing.T, s string) []byte {
+    t.Helper()
+    b, err := hex.DecodeString(s)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return b
+}
+
+func count(from byte, n int) []byte {
+    b := make([]byte, n)
+    for i := range b {
+        b[i] = from + byte(i)
+    }
+    return b
+}
+
+// The expected values were worked out independently of this package, with
+// HKDF-SHA256 straight from RFC 5869.
+func TestCombineHybridKAT(t *testing.T) {
+    vectors := []struct {
+        mlkemShared, x25519Shared, ciphertext, public []byte
+        want string
+    }{
+        {
+            count(0x00, 32),
+            count(0x20, 32),
+            count(0x40, 32),
+            count(0x60, 32),
+            "e90ea3fe9a78efa3d26cf78b462643da525fd0042f759fe1b64000cbc2aa959b",
+        },
+        {
+            bytes.Repeat([]byte{0xff}, 32),
+            bytes.Repeat([]byte{0x00}, 32),
+            bytes.Repeat([]byte{0x11}, 32),
+            bytes.Repeat([]byte{0x22}, 32),
+            "26389c18ba261d7185340e76a24344845f821b67a195b5621db4b1ea516f2d6e",
+        },
+    }
+    for i, v := range vectors {
+        shared, err := CombineHybrid(
+            v.mlkemShared,
+            v.x25519Shared,
+            v.ciphertext,
+            v.public,
+        )
+        if err != nil {
+            t.Fatal(err)
+        }
+        if got := hex.EncodeToString(shared); got != v.want {
+            t.Errorf("vector %d: got %s, want %s", i, got, v.want)
+        }
+    }
+}
+
+// Every input, and the label, has to make a difference. Otherwise somebody
+// could swap one for another and end up with the same key.
+func TestCombineHybridBindsInputs(t *testing.T) {
+    a, b, c, d := count(0x00, 32), count(0x20, 32), count(0x40, 32), count(0x60, 32)
+    want, err := CombineHybrid(a, b, c, d)
+    if err != nil {
+        t.Fatal(err)
+    }
+    swaps := map[string][4][]byte{
+        "shared secrets swapped": {b, a, c, d},
+        "ciphertext and public key swapped": {a, b, d, c},
+        "wrong ciphertext": {a, b, count(0x41, 32), d},
+        "wrong public key": {a, b, c, count(0x61, 32)},
+    }
+    for name, in := range swaps {
+        got, err := CombineHybrid(in[0], in[1], in[2], in[3])
+        if err != nil {
+            t.Fatal(err)
+        }
+        if bytes.Equal(got, want) {
+            t.Errorf("%s: same result", name)
+        }
+    }
+    // The same inputs under another label (the one wrapKey uses).
+    info := append([]byte("blur group key"), c...)
+    info = append(info, d...)
+    relabeled := make([]byte, KEYSIZE)
+    secret := append(append([]byte{}, a...), b...)
+    _, err = io.ReadFull(hkdf.New(sha256.New, secret, nil, info), relabeled)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if bytes.Equal(relabeled, want) {
+        t.Error("swapped label: same result")
+    }
+}
+
+// RFC 7748, section 6.1.
+func TestDecapsulateX25519KAT(t *testing.T) {
+    private, err := ecdh.X25519().NewPrivateKey(unhex(t,
+        "77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a",
+    ))
+    if err != nil {
+        t.Fatal(err)
+    }
+    kp := KeyPair{kx: X25519, private: private}
+    wantPublic := "8520f0098930a754748b7ddcb43ef75a0dbf3a0d26381af4eba4a98eaa9b4e6a"
+    if got := hex.EncodeToString(kp.Public()); got != wantPublic {
+        t.Errorf("public key: got %s, want %s", got, wantPublic)
+    }
+    shared, err := kp.Decapsulate(unhex(t,
+        "de9edb7d7b7dc1b4d35b61c2ece435373f8343c85b78674dadfc7e146f882b4f",
+    ))
+    if err != nil {
+        t.Fatal(err)
+    }
+    want := "4a5d9d5ba4ce2de1728e3bf480350f25e07e21c947d19e3376f09b3c1e161742"
+    if got := hex.EncodeToString(shared); got != want {
+        t.Errorf("shared secret: got %s, want %s", got, want)
+    }
+}
+
+var exchanges = []KeyExchange{X25519, X25519MLKEM768}
+
+func TestEncapsulateRoundTrip(t *testing.T) {
+    for _, kx := range exchanges {
+        t.Run(kx.String(), func(t *testing.T) {
+            kp, err := GenKeyPair(kx)
+            if err != nil {
+                t.Fatal(err)
+            }
+            ciphertext, shared, err := kx.Encapsulate(kp.Public())
+            if err != nil {
+                t.Fatal(err)
+            }
+            if len(ciphertext) != kx.CiphertextSize() {
+                t.Fatalf("ciphertext is %d bytes", len(ciphertext))
+            }
+            got, err := kp.Decapsulate(ciphertext)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if !bytes.Equal(got, shared) {
+                t.Fatal("shared secrets differ")
+            }
+        })
+    }
+}
+
+// ML-KEM doesn't fail on a bad ciphertext, it just comes up with another
+// secret, so tampering has to show up as a mismatch rather than an error.
+func TestEncapsulateTampered(t *testing.T) {
+    for _, kx := range exchanges {
+        t.Run(kx.String(), func(t *testing.T) {
+            kp, err := GenKeyPair(kx)
+            if err != nil {
+                t.Fatal(err)
+            }
+            other, err := GenKeyPair(kx)
+            if err != nil {
+                t.Fatal(err)
+            }
+            ciphertext, shared, err := kx.Encapsulate(kp.Public())
+            if err != nil {
+                t.Fatal(err)
+            }
+            // Flipping a bit in either half.
+            halves := map[string]int{"x25519": 0}
+            if kx == X25519MLKEM768 {
+                halves["mlkem"] = len(ciphertext) - 1
+            }
+            for half, at := range halves {
+                tampered := bytes.Clone(ciphertext)
+                tampered[at] ^= 1
+                got, err := kp.Decapsulate(tampered)
+                if err == nil && bytes.Equal(got, shared) {
+                    t.Errorf("wrong %s ciphertext: same secret", half)
+                }
+            }
+            // Somebody else's key.
+            got, err := other.Decapsulate(ciphertext)
+            if err == nil && bytes.Equal(got, shared) {
+                t.Error("wrong key pair: same secret")
+            }
+            // A public key of the wrong size.
+            _, _, err = kx.Encapsulate(kp.Public()[1:])
+            if err == nil {
+                t.Error("short public key accepted")
+            }
+        })
+    }
+}
+
+func TestSealKeyRoundTrip(t *testing.T) {
+    authKey := count(0x80, KEYSIZE)
+    for _, kx := range exchanges {
+        for _, suite := range []Suite{AES256GCM, ChaCha20Poly1305} {
+            t.Run(kx.String() + "/" + suite.String(), func(t *testing.T) {
+                kp, err := GenKeyPair(kx)
+                if err != nil {
+                    t.Fatal(err)
+                }
+                key, err := NewGroupKey()
+                if err != nil {
+                    t.Fatal(err)
+                }
+                sealed, err := SealKey(kx, suite, kp.Public(), authKey, key)
+                if err != nil {
+                    t.Fatal(err)
+                }
+                opened, err := kp.OpenKey(suite, authKey, sealed)
+                if err != nil {
+                    t.Fatal(err)
+                }
+                if !bytes.Equal(opened, key) {
+                    t.Fatal("opened a different key")
+                }
+            })
+        }
+    }
+}
+
+func TestOpenKeyTampered(t *testing.T) {
+    authKey := count(0x80, KEYSIZE)
+    for _, kx := range exchanges {
+        t.Run(kx.String(), func(t *testing.T) {
+            kp, err := GenKeyPair(kx)
+            if err != nil {
+                t.Fatal(err)
+            }
+            other, err := GenKeyPair(kx)
+            if err != nil {
+                t.Fatal(err)
+            }
+            key, err := NewGroupKey()
+            if err != nil {
+                t.Fatal(err)
+            }
+            sealed, err := SealKey(kx, AES256GCM, kp.Public(), authKey, key)
+            if err != nil {
+                t.Fatal(err)
+            }
+            tamper := func(at int) []byte {
+                tampered := bytes.Clone(sealed)
+                tampered[at] ^= 1
+                return tampered
+            }
+            cases := []struct {
+                name string
+                kp KeyPair
+                authKey []byte
+                sealed []byte
+            }{
+                {"wrong x25519 ciphertext", kp, authKey, tamper(0)},
+                {"wrong kem ciphertext", kp, authKey, tamper(kx.CiphertextSize() - 1)},
+                {"wrong sealed key", kp, authKey, tamper(len(sealed) - 1)},
+                {"wrong key pair", other, authKey, sealed},
+                {"wrong passphrase key", kp, count(0x81, KEYSIZE), sealed},
+                {"truncated", kp, authKey, sealed[:kx.CiphertextSize() - 1]},
+            }
+            for _, c := range cases {
+                if _, err := c.kp.OpenKey(AES256GCM, c.authKey, c.sealed); err == nil {
+                    t.Errorf("%s: opened anyway", c.name)
+                }
+            }
+            // Sealed under one suite, opened under the other.
+            if _, err := kp.OpenKey(ChaCha20Poly1305, authKey, sealed); err == nil {
+                t.Error("wrong suite: opened anyway")
+            }
+        })
+    }
+}
@@ -1,7 +1,11 @@
 package secure
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
+
+	"golang.org/x/crypto/argon2"
 )
 
 func Hash(sessionKey []byte) []byte {
@@ -9,3 +13,30 @@ func Hash(sessionKey []byte) []byte {
     h.Write(sessionKey)
     return h.Sum(nil)
 }
+
+const SaltSize int = 16
+
+func NewSalt() (salt []byte, err error) {
+    salt = make([]byte, SaltSize)
+    _, err = rand.Read(salt)
+    return
+}
+
+// What the server keeps of a session key's verifier when it has to write it
+// down: argon2id with the parameters OWASP suggests, so that somebody with
+// the file has to pay for every guess, and can't pay once for all sessions.
+func HashVerifier(verifier []byte, salt []byte) []byte {
+    return argon2.IDKey(verifier, salt, 2, 19 * 1024, 1, uint32(KEYSIZE))
+}
+
+const MACSIZE int = sha256.Size
+
+func MAC(key []byte, data []byte) []byte {
+    h := hmac.New(sha256.New, key)
+    h.Write(data)
+    return h.Sum(nil)
+}
+
+func VerifyMAC(key []byte, data []byte, mac []byte) bool {
+    return hmac.Equal(MAC(key, data), mac)
+}
@@ -0,0 +1,98 @@
+package secure
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type paddingKind byte
+
+const (
+    padNone paddingKind = iota
+    padPow2
+    padBlock
+)
+
+// Past this, powers of two waste more than they hide, so pow2 padding rounds
+// up to multiples of it instead.
+const maxBucket int = 1 << 14
+
+// Padding decides how far plaintexts are padded before encryption, so that the
+// size of a message says as little as possible about what's in it. Whatever
+// the setting, a 0x80 byte marks where the padding starts (ISO/IEC 7816-4), so
+// the receiver never needs to know how the sender padded.
+type Padding struct {
+    kind paddingKind
+    block int
+}
+
+var NoPadding = Padding{kind: padNone}
+
+// Accepts "none", "pow2", or "block:<size>".
+func ParsePadding(spec string) (padding Padding, err error) {
+    switch {
+    case spec == "" || spec == "none":
+        padding = NoPadding
+    case spec == "pow2":
+        padding = Padding{kind: padPow2}
+    case strings.HasPrefix(spec, "block:"):
+        var block int
+        block, err = strconv.Atoi(strings.TrimPrefix(spec, "block:"))
+        if err != nil || block < 1 || block > maxBucket {
+            err = fmt.Errorf("invalid padding block size: %s", spec)
+            return
+        }
+        padding = Padding{kind: padBlock, block: block}
+    default:
+        err = fmt.Errorf("unknown padding: %s", spec)
+    }
+    return
+}
+
+func (padding Padding) bucket(size int) int {
+    switch padding.kind {
+    case padPow2:
+        if size > maxBucket {
+            return roundUp(size, maxBucket)
+        }
+        bucket := 32
+        for bucket < size {
+            bucket *= 2
+        }
+        return bucket
+    case padBlock:
+        return roundUp(size, padding.block)
+    }
+    return size
+}
+
+func roundUp(size int, block int) int {
+    return (size + block - 1) / block * block
+}
+
+func (padding Padding) Pad(data []byte) (padded []byte) {
+    // The marker always fits, so the bucket is for data plus the marker.
+    size := padding.bucket(len(data) + 1)
+    padded = make([]byte, size)
+    copy(padded, data)
+    padded[len(data)] = 0x80
+    return
+}
+
+func Unpad(padded []byte) (data []byte, err error) {
+    end := bytes.LastIndexByte(padded, 0x80)
+    if end < 0 {
+        err = fmt.Errorf("invalid padding")
+        return
+    }
+    for _, b := range padded[end+1:] {
+        if b != 0 {
+            err = fmt.Errorf("invalid padding")
+            return
+        }
+    }
+    data = padded[:end]
+    return
+}
@@ -0,0 +1,78 @@
+package secure
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPadRoundTrip(t *testing.T) {
+    for _, spec := range []string{"none", "pow2", "block:16", "block:100"} {
+        padding, err := ParsePadding(spec)
+        if err != nil {
+            t.Fatal(err)
+        }
+        // The smallest bucket, whatever the setting.
+        block := padding.bucket(1)
+        for _, size := range []int{0, block - 1, block, block + 1} {
+            // 0x80 in the data can't be mistaken for the marker.
+            data := bytes.Repeat([]byte{0x80}, size)
+            padded := padding.Pad(data)
+            if len(padded) <= size || len(padded) != padding.bucket(size + 1) {
+                t.Errorf("%s: %d bytes padded to %d", spec, size, len(padded))
+            }
+            unpadded, err := Unpad(padded)
+            if err != nil {
+                t.Errorf("%s: %d bytes: %s", spec, size, err)
+                continue
+            }
+            if !bytes.Equal(unpadded, data) {
+                t.Errorf("%s: %d bytes came back as %d", spec, size, len(unpadded))
+            }
+        }
+    }
+}
+
+func TestPadBuckets(t *testing.T) {
+    pow2, _ := ParsePadding("pow2")
+    block, _ := ParsePadding("block:16")
+    for _, c := range []struct {
+        padding Padding
+        size, want int
+    }{
+        {pow2, 1, 32},
+        {pow2, 33, 64},
+        {pow2, maxBucket + 1, 2 * maxBucket},
+        {block, 1, 16},
+        {block, 16, 16},
+        {block, 17, 32},
+    } {
+        if got := c.padding.bucket(c.size); got != c.want {
+            t.Errorf("%d bytes go in %d, not %d", c.size, got, c.want)
+        }
+    }
+}
+
+func TestUnpadRejectsMalformed(t *testing.T) {
+    for _, padded := range [][]byte{
+        nil,
+        {},
+        // No marker at all.
+        {0, 0, 0, 0},
+        {'h', 'i'},
+        // Something other than zeroes after the marker.
+        {'h', 'i', 0x80, 0, 1},
+        {'h', 'i', 0x80, 0x7f},
+    } {
+        if _, err := Unpad(padded); err == nil {
+            t.Errorf("unpadded %v", padded)
+        }
+    }
+}
+
+func TestParsePaddingRejects(t *testing.T) {
+    for _, spec := range []string{"pow3", "block:", "block:0", "block:-1", "block:x", "block:100000"} {
+        if _, err := ParsePadding(spec); err == nil {
+            t.Errorf("accepted %s", spec)
+        }
+    }
+}
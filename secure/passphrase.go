@@ -0,0 +1,121 @@
+package secure
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/sethvargo/go-diceware/diceware"
+)
+
+// Six words from the EFF list are a little over 77 bits.
+const PassphraseWords int = 6
+
+// Every word in the EFF large list is worth log2(6^5) bits.
+var wordBits = 5 * math.Log2(6)
+
+var effWords = sync.OnceValue(func() map[string]bool {
+    list := diceware.WordListEffLarge()
+    words := make(map[string]bool)
+    for i := 11111; i <= 66666; i++ {
+        if word := list.WordAt(i); word != "" {
+            words[word] = true
+        }
+    }
+    return words
+})
+
+// GeneratePassphrase picks words at random from the EFF large word list and
+// joins them with dashes, so the result survives being read out loud.
+func GeneratePassphrase(words int) (passphrase string, err error) {
+    list, err := diceware.Generate(words)
+    if err != nil {
+        return
+    }
+    passphrase = strings.Join(list, "-")
+    return
+}
+
+// Entropy estimates how many bits it would take to guess passphrase. A
+// passphrase made up only of EFF words is counted as if the words were picked
+// at random, which is what GeneratePassphrase does. Anything else is counted
+// character by character against the classes of characters it uses, with
+// repeats and runs like "aaa" or "1234" counting for next to nothing.
+func Entropy(passphrase string) float64 {
+    words := strings.FieldsFunc(passphrase, func(r rune) bool {
+        return r == '-' || r == ' '
+    })
+    if len(words) > 1 {
+        all := true
+        for _, word := range words {
+            if !effWords()[strings.ToLower(word)] {
+                all = false
+                break
+            }
+        }
+        if all {
+            return float64(len(words)) * wordBits
+        }
+    }
+    var lower, upper, digit, symbol, other bool
+    for _, r := range passphrase {
+        switch {
+        case r >= 'a' && r <= 'z':
+            lower = true
+        case r >= 'A' && r <= 'Z':
+            upper = true
+        case r >= '0' && r <= '9':
+            digit = true
+        case r < unicode.MaxASCII && unicode.IsPrint(r):
+            symbol = true
+        default:
+            other = true
+        }
+    }
+    pool := 0
+    if lower {
+        pool += 26
+    }
+    if upper {
+        pool += 26
+    }
+    if digit {
+        pool += 10
+    }
+    if symbol {
+        pool += 33
+    }
+    if other {
+        pool += 100
+    }
+    if pool == 0 {
+        return 0
+    }
+    charBits := math.Log2(float64(pool))
+    bits := 0.0
+    var prev rune = -1
+    for _, r := range passphrase {
+        diff := r - prev
+        if prev >= 0 && diff >= -1 && diff <= 1 {
+            bits += 1
+        } else {
+            bits += charBits
+        }
+        prev = r
+    }
+    return bits
+}
+
+// Strength puts a rough name to an Entropy estimate.
+func Strength(bits float64) string {
+    switch {
+    case bits < 40:
+        return "weak"
+    case bits < 60:
+        return "fair"
+    case bits < 80:
+        return "good"
+    }
+    return "strong"
+}
@@ -0,0 +1,69 @@
+package secure
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestEntropyGenerated(t *testing.T) {
+    for i := 0; i < 10; i++ {
+        passphrase, err := GeneratePassphrase(PassphraseWords)
+        if err != nil {
+            t.Fatal(err)
+        }
+        bits := Entropy(passphrase)
+        if math.Abs(bits - float64(PassphraseWords) * wordBits) > 0.001 {
+            t.Fatalf("'%s' is %.1f bits", passphrase, bits)
+        }
+        // Spaces and case don't make the words any easier to guess.
+        spaced := strings.ToUpper(strings.ReplaceAll(passphrase, "-", " "))
+        if Entropy(spaced) != bits {
+            t.Fatalf("'%s' is %.1f bits", spaced, Entropy(spaced))
+        }
+    }
+}
+
+func TestEntropyCharacters(t *testing.T) {
+    for _, c := range []struct {
+        passphrase string
+        want float64
+    }{
+        {"", 0},
+        // A run counts a bit per character after the first, like the
+        // second s here.
+        {"password", 7 * math.Log2(26) + 1},
+        {"abcd", math.Log2(26) + 3},
+        {"aaaa", math.Log2(26) + 3},
+        {"1234", math.Log2(10) + 3},
+        {"Ab1!", 4 * math.Log2(26 + 26 + 10 + 33)},
+    } {
+        if got := Entropy(c.passphrase); math.Abs(got - c.want) > 0.001 {
+            t.Errorf("'%s' is %.1f bits, want %.1f", c.passphrase, got, c.want)
+        }
+    }
+}
+
+// Words only count as words when every one of them is on the list.
+func TestEntropyMixedWords(t *testing.T) {
+    if bits := Entropy("abacus-abdomen"); math.Abs(bits - 2 * wordBits) > 0.001 {
+        t.Fatalf("two words are %.1f bits", bits)
+    }
+    if Entropy("abacus-xqzvbn") == 2 * wordBits {
+        t.Fatal("counted a word that isn't on the list")
+    }
+}
+
+func TestStrength(t *testing.T) {
+    for bits, want := range map[float64]string{
+        0: "weak",
+        39.9: "weak",
+        40: "fair",
+        60: "good",
+        80: "strong",
+    } {
+        if got := Strength(bits); got != want {
+            t.Errorf("%.1f bits is %s, want %s", bits, got, want)
+        }
+    }
+}
@@ -0,0 +1,89 @@
+package secure
+
+import "sync"
+
+// Secret keeps key bytes in memory of their own until Wipe zeroes them. Where
+// the system allows it, that memory is locked so it never ends up in swap (or
+// in a core dump).
+type Secret struct {
+    mu sync.Mutex
+    data []byte
+    mapped bool
+}
+
+// Every secret that hasn't been wiped yet, so WipeAll can get to them on the
+// way out.
+var (
+    secretsMu sync.Mutex
+    secrets = make(map[*Secret]struct{})
+)
+
+// NewSecret takes key over: it is copied into a Secret and then zeroed.
+func NewSecret(key []byte) *Secret {
+    secret := AllocSecret(len(key))
+    copy(secret.data, key)
+    Zero(key)
+    return secret
+}
+
+// AllocSecret is a zeroed Secret of size bytes, for anything that has to be
+// put together in place rather than copied in.
+func AllocSecret(size int) *Secret {
+    secret := &Secret{}
+    secret.data, secret.mapped = allocate(size)
+    secretsMu.Lock()
+    secrets[secret] = struct{}{}
+    secretsMu.Unlock()
+    return secret
+}
+
+// The key itself, or nil once the secret is wiped. Don't hold on to it.
+func (secret *Secret) Bytes() []byte {
+    if secret == nil {
+        return nil
+    }
+    secret.mu.Lock()
+    defer secret.mu.Unlock()
+    return secret.data
+}
+
+func (secret *Secret) Wipe() {
+    secret.wipe(true)
+}
+
+func (secret *Secret) wipe(unmap bool) {
+    if secret == nil {
+        return
+    }
+    secret.mu.Lock()
+    if secret.data != nil {
+        Zero(secret.data)
+        if secret.mapped && unmap {
+            release(secret.data)
+        }
+        secret.data = nil
+    }
+    secret.mu.Unlock()
+    secretsMu.Lock()
+    delete(secrets, secret)
+    secretsMu.Unlock()
+}
+
+// WipeAll wipes every secret still around, for when we're on the way out.
+// The memory is only zeroed, not given back, so anything still in the middle
+// of using a secret reads zeroes instead of crashing.
+func WipeAll() {
+    secretsMu.Lock()
+    all := make([]*Secret, 0, len(secrets))
+    for secret := range secrets {
+        all = append(all, secret)
+    }
+    secretsMu.Unlock()
+    for _, secret := range all {
+        secret.wipe(false)
+    }
+}
+
+func Zero(data []byte) {
+    clear(data)
+}
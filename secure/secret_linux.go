@@ -0,0 +1,32 @@
+//go:build linux
+
+package secure
+
+import "golang.org/x/sys/unix"
+
+// Secrets get pages of their own, so locking (and later unlocking) one never
+// touches memory that belongs to anything else. If the system won't hand out
+// or lock such a page, the secret still works, it just might get swapped.
+func allocate(size int) (data []byte, mapped bool) {
+    if size == 0 {
+        return []byte{}, false
+    }
+    data, err := unix.Mmap(
+        -1,
+        0,
+        size,
+        unix.PROT_READ|unix.PROT_WRITE,
+        unix.MAP_ANON|unix.MAP_PRIVATE,
+    )
+    if err != nil {
+        return make([]byte, size), false
+    }
+    unix.Mlock(data)
+    unix.Madvise(data, unix.MADV_DONTDUMP)
+    return data, true
+}
+
+func release(data []byte) {
+    unix.Munlock(data)
+    unix.Munmap(data)
+}
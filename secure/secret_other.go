@@ -0,0 +1,11 @@
+//go:build !linux
+
+package secure
+
+// Elsewhere, secrets are plain memory that still gets zeroed, but may be
+// swapped out before it is.
+func allocate(size int) (data []byte, mapped bool) {
+    return make([]byte, size), false
+}
+
+func release(data []byte) {}
@@ -0,0 +1,49 @@
+package secure
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+)
+
+const SIGSIZE int = ed25519.SignatureSize
+
+// LoadSigningKey reads the server's long-term Ed25519 key from path, creating
+// it on the first run. Clients pin the public half, so it has to stick around.
+func LoadSigningKey(path string) (key ed25519.PrivateKey, err error) {
+    seed, err := os.ReadFile(path)
+    if os.IsNotExist(err) {
+        seed = make([]byte, ed25519.SeedSize)
+        if _, err = rand.Read(seed); err != nil {
+            return
+        }
+        err = os.WriteFile(path, seed, 0600)
+    }
+    if err != nil {
+        return
+    }
+    if len(seed) != ed25519.SeedSize {
+        err = fmt.Errorf("invalid signing key in %s", path)
+        return
+    }
+    key = ed25519.NewKeyFromSeed(seed)
+    return
+}
+
+func Sign(key ed25519.PrivateKey, data []byte) []byte {
+    return ed25519.Sign(key, data)
+}
+
+func VerifySignature(pub []byte, data []byte, signature []byte) bool {
+    if len(pub) != ed25519.PublicKeySize {
+        return false
+    }
+    return ed25519.Verify(pub, data, signature)
+}
+
+// What users compare (and what gets pinned) instead of the raw key.
+func Fingerprint(pub []byte) string {
+    return hex.EncodeToString(Hash(pub))
+}
@@ -0,0 +1,64 @@
+package secure
+
+import (
+	"crypto/cipher"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Suite selects the AEAD a session encrypts with. It is picked by whoever
+// creates the session and announced to joiners.
+type Suite byte
+
+const (
+    AES256GCM Suite = iota
+    // Faster than AES-GCM on machines without AES instructions.
+    ChaCha20Poly1305
+    // Like ChaCha20Poly1305, but with 24-byte nonces that are safe to pick at
+    // random for as many messages as anybody will ever send.
+    XChaCha20Poly1305
+)
+
+func ParseSuite(name string) (suite Suite, err error) {
+    switch name {
+    case "", "aes-256-gcm":
+        suite = AES256GCM
+    case "chacha20-poly1305":
+        suite = ChaCha20Poly1305
+    case "xchacha20-poly1305":
+        suite = XChaCha20Poly1305
+    default:
+        err = fmt.Errorf("unknown cipher suite: %s", name)
+    }
+    return
+}
+
+func (suite Suite) String() string {
+    switch suite {
+    case AES256GCM:
+        return "aes-256-gcm"
+    case ChaCha20Poly1305:
+        return "chacha20-poly1305"
+    case XChaCha20Poly1305:
+        return "xchacha20-poly1305"
+    }
+    return fmt.Sprintf("unknown (%d)", byte(suite))
+}
+
+func (suite Suite) Supported() bool {
+    return suite <= XChaCha20Poly1305
+}
+
+func (suite Suite) NewAEAD(key []byte) (aead cipher.AEAD, err error) {
+    switch suite {
+    case AES256GCM:
+        return BuildAesGCM(key)
+    case ChaCha20Poly1305:
+        return chacha20poly1305.New(key)
+    case XChaCha20Poly1305:
+        return chacha20poly1305.NewX(key)
+    }
+    err = fmt.Errorf("unsupported cipher suite: %s", suite)
+    return
+}
@@ -0,0 +1,79 @@
+package secure
+
+import (
+	"bytes"
+	"testing"
+)
+
+var suites = []Suite{AES256GCM, ChaCha20Poly1305, XChaCha20Poly1305}
+
+func TestSuiteRoundTrip(t *testing.T) {
+    key := count(0, KEYSIZE)
+    for _, suite := range suites {
+        aead, err := suite.NewAEAD(key)
+        if err != nil {
+            t.Fatalf("%s: %s", suite, err)
+        }
+        sealed, err := EncryptData(aead, []byte("hello"), NoPadding)
+        if err != nil {
+            t.Fatalf("%s: %s", suite, err)
+        }
+        opened, err := DecryptData(aead, sealed)
+        if err != nil {
+            t.Fatalf("%s: %s", suite, err)
+        }
+        if string(opened) != "hello" {
+            t.Fatalf("%s: opened '%s'", suite, opened)
+        }
+        sealed[len(sealed) - 1] ^= 1
+        if _, err = DecryptData(aead, sealed); err == nil {
+            t.Fatalf("%s: opened a tampered ciphertext", suite)
+        }
+    }
+}
+
+// Even under the same key, what one suite sealed never opens under another.
+func TestSuitesDontMix(t *testing.T) {
+    key := count(0, KEYSIZE)
+    for _, from := range suites {
+        sealer, err := from.NewAEAD(key)
+        if err != nil {
+            t.Fatal(err)
+        }
+        sealed, err := EncryptData(sealer, []byte("hello"), NoPadding)
+        if err != nil {
+            t.Fatal(err)
+        }
+        for _, to := range suites {
+            if to == from {
+                continue
+            }
+            opener, err := to.NewAEAD(key)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if _, err = DecryptData(opener, bytes.Clone(sealed)); err == nil {
+                t.Errorf("%s opened what %s sealed", to, from)
+            }
+        }
+    }
+}
+
+func TestParseSuite(t *testing.T) {
+    for _, suite := range suites {
+        parsed, err := ParseSuite(suite.String())
+        if err != nil || parsed != suite {
+            t.Errorf("%s came back as %s (%v)", suite, parsed, err)
+        }
+    }
+    if _, err := ParseSuite("rot13"); err == nil {
+        t.Error("accepted an unknown suite")
+    }
+    unknown := XChaCha20Poly1305 + 1
+    if unknown.Supported() {
+        t.Error("an unknown suite is supported")
+    }
+    if _, err := unknown.NewAEAD(count(0, KEYSIZE)); err == nil {
+        t.Error("built an AEAD for an unknown suite")
+    }
+}
@@ -2,44 +2,79 @@ package sender
 
 import (
 	"encoding/binary"
+	"fmt"
+	"math"
 	"net"
+	"time"
 	"github.com/therekrab/blur/message"
 )
 
-func SendReject(conn net.Conn, keyFailed bool) (err error) {
-    reason := make([]byte, 1)
-    if keyFailed {
-        reason[0] = 1
-    }
-    rejMsg := message.NewMessage(1, message.REJ, reason)
+func SendReject(conn net.Conn, reason message.RejReason) (err error) {
+    rejMsg := message.NewMessage(1, message.REJ, []byte{byte(reason)})
     err = rejMsg.SendTo(conn)
     return
 }
 
-func SendAcc(conn net.Conn) (err error) {
-    accMsg := message.NewMessage(0, message.ACC, nil)
+func SendAcc(conn net.Conn, params []byte) (err error) {
+    accMsg := message.NewMessage(uint16(len(params)), message.ACC, params)
     err = accMsg.SendTo(conn)
     return
 }
 
-func SendNew(conn net.Conn, sessionID uint16) (err error) {
-    sessionIDBytes := make([]byte, 2)
-    binary.BigEndian.PutUint16(sessionIDBytes, sessionID)
-    newMsg := message.NewMessage(2, message.NEW, sessionIDBytes)
+func SendNew(
+    conn net.Conn,
+    sessionID uint16,
+    ttl time.Duration,
+    ownerSecret []byte,
+) (err error) {
+    data := make([]byte, 2)
+    binary.BigEndian.PutUint16(data, sessionID)
+    data = binary.BigEndian.AppendUint32(data, uint32(ttl / time.Second))
+    data = append(data, ownerSecret...)
+    newMsg := message.NewMessage(uint16(len(data)), message.NEW, data)
     err = newMsg.SendTo(conn)
     return
 }
 
-func SendNewR(conn net.Conn, sessionKeyHashed []byte) (err error) {
+func SendNewR(
+    conn net.Conn,
+    sessionKeyHashed []byte,
+    salt []byte,
+    ttl time.Duration,
+    params []byte,
+) (err error) {
+    data := append([]byte{}, sessionKeyHashed...)
+    data = append(data, salt...)
+    data = binary.BigEndian.AppendUint32(data, uint32(ttl / time.Second))
+    data = append(data, params...)
     newRMsg := message.NewMessage(
-        uint16(len(sessionKeyHashed)),
+        uint16(len(data)),
         message.NEWR,
-        sessionKeyHashed,
+        data,
     )
     err = newRMsg.SendTo(conn)
     return
 }
 
+// Tells a client its JOIN? is waiting for an owner to decide.
+func SendWait(conn net.Conn) (err error) {
+    waitMsg := message.NewMessage(0, message.WAIT, nil)
+    err = waitMsg.SendTo(conn)
+    return
+}
+
+func SendName(conn net.Conn, ident []byte) (err error) {
+    nameMsg := message.NewMessage(uint16(len(ident)), message.NAME, ident)
+    err = nameMsg.SendTo(conn)
+    return
+}
+
+func SendServerKey(conn net.Conn, pub []byte) (err error) {
+    keyMsg := message.NewMessage(uint16(len(pub)), message.SRVKEY, pub)
+    err = keyMsg.SendTo(conn)
+    return
+}
+
 func SendIdentR(conn net.Conn) (err error) {
     identRMsg := message.NewMessage(0, message.IDENTR, nil)
     err = identRMsg.SendTo(conn)
@@ -55,16 +90,42 @@ func SendIdent(conn net.Conn, idents [][]byte) (err error) {
     return
 }
 
+func SendRoster(conn net.Conn, idents [][]byte, owners [][]byte) (err error) {
+    rosterMsg, err := message.NewRoster(idents, owners)
+    if err != nil {
+        return err
+    }
+    err = rosterMsg.SendTo(conn)
+    return
+}
+
+// Asks for the salt of a session, before joining it.
+func SendSaltR(conn net.Conn, sessionID uint16) (err error) {
+    data := make([]byte, 2)
+    binary.BigEndian.PutUint16(data, sessionID)
+    saltRMsg := message.NewMessage(uint16(len(data)), message.SALTR, data)
+    err = saltRMsg.SendTo(conn)
+    return
+}
+
+func SendSalt(conn net.Conn, salt []byte) (err error) {
+    saltMsg := message.NewMessage(uint16(len(salt)), message.SALT, salt)
+    err = saltMsg.SendTo(conn)
+    return
+}
+
 func SendJoinR(
     conn net.Conn,
     sessionID uint16,
     sessionKeyHash []byte,
+    ident []byte,
 ) (err error) {
     data := make([]byte, 2)
     binary.BigEndian.PutUint16(data, sessionID)
     data = append(data, sessionKeyHash...)
+    data = append(data, ident...)
     joinMsg := message.NewMessage(
-        uint16(len(sessionKeyHash) + 2),
+        uint16(len(data)),
         message.JOINR,
         data,
     )
@@ -81,3 +142,71 @@ func SendChatE(conn net.Conn, data []byte) (err error) {
     err = chtEMsg.SendTo(conn)
     return
 }
+
+func SendKeyR(conn net.Conn, pub []byte) (err error) {
+    keyRMsg := message.NewMessage(uint16(len(pub)), message.KEYR, pub)
+    err = keyRMsg.SendTo(conn)
+    return
+}
+
+func SendKey(
+    conn net.Conn,
+    recipient []byte,
+    sender []byte,
+    epoch uint32,
+    sealed []byte,
+) (err error) {
+    data := append([]byte{}, recipient...)
+    data = append(data, sender...)
+    data = binary.BigEndian.AppendUint32(data, epoch)
+    data = append(data, sealed...)
+    keyMsg := message.NewMessage(uint16(len(data)), message.KEY, data)
+    err = keyMsg.SendTo(conn)
+    return
+}
+
+func SendRekey(conn net.Conn, data []byte) (err error) {
+    if len(data) > math.MaxUint16 {
+        err = fmt.Errorf("too many members to rekey in one message")
+        return
+    }
+    rekeyMsg := message.NewMessage(uint16(len(data)), message.REKEY, data)
+    err = rekeyMsg.SendTo(conn)
+    return
+}
+
+func SendOwn(conn net.Conn, ownerSecret []byte) (err error) {
+    ownMsg := message.NewMessage(
+        uint16(len(ownerSecret)),
+        message.OWN,
+        ownerSecret,
+    )
+    err = ownMsg.SendTo(conn)
+    return
+}
+
+func SendMod(
+    conn net.Conn,
+    action message.ModAction,
+    arg []byte,
+) (err error) {
+    data := append([]byte{byte(action)}, arg...)
+    if len(data) > math.MaxUint16 {
+        err = fmt.Errorf("MOD too large")
+        return
+    }
+    modMsg := message.NewMessage(uint16(len(data)), message.MOD, data)
+    err = modMsg.SendTo(conn)
+    return
+}
+
+// Tells the client why the server didn't do what it asked.
+func SendErr(conn net.Conn, reason string) (err error) {
+    errMsg := message.NewMessage(
+        uint16(len(reason)),
+        message.ERR,
+        []byte(reason),
+    )
+    err = errMsg.SendTo(conn)
+    return
+}
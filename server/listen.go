@@ -0,0 +1,201 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"github.com/therekrab/blur/cfg"
+	"github.com/therekrab/blur/errorhandling"
+	"github.com/therekrab/blur/secure"
+	"github.com/therekrab/blur/ui"
+	"golang.org/x/net/websocket"
+)
+
+// A listener hands connections to handleClient, either straight off the
+// socket, or out of WebSocket upgrades on an HTTP server for clients that can
+// only get out over HTTP. Both speak the same messages, so they end up in the
+// same sessions.
+type listener struct {
+    ln net.Listener
+    websocket bool
+}
+
+// Listen addresses look like "0.0.0.0:4040" (or "tcp:0.0.0.0:4040") for raw
+// TCP, "ws:0.0.0.0:8080" for WebSockets, or "unix:/run/blur.sock" for a Unix
+// socket that only local users (allowed by unixCfg) can reach.
+func listen(
+    spec string,
+    unixCfg cfg.UnixCfg,
+    tlsConfig *tls.Config,
+) (l listener, err error) {
+    network, addr, found := strings.Cut(spec, ":")
+    switch {
+    case found && network == "unix":
+        l.ln, err = listenUnix(addr, unixCfg)
+    case found && network == "ws":
+        l.websocket = true
+        l.ln, err = net.Listen("tcp", addr)
+    case found && network == "tcp":
+        l.ln, err = net.Listen("tcp", addr)
+    default:
+        l.ln, err = net.Listen("tcp", spec)
+    }
+    if err != nil {
+        return
+    }
+    if tlsConfig != nil {
+        l.ln = tls.NewListener(l.ln, tlsConfig)
+    }
+    return
+}
+
+func listenUnix(path string, unixCfg cfg.UnixCfg) (ln net.Listener, err error) {
+    // A socket left over from a server that didn't shut down cleanly would
+    // keep us from listening. Anything else at that path is left alone.
+    if info, statErr := os.Lstat(path); statErr == nil {
+        if info.Mode().Type() != os.ModeSocket {
+            err = fmt.Errorf("%s exists and is not a socket", path)
+            return
+        }
+        if err = os.Remove(path); err != nil {
+            return
+        }
+    }
+    ln, err = net.Listen("unix", path)
+    if err != nil {
+        return
+    }
+    defer func() {
+        if err != nil {
+            ln.Close()
+        }
+    }()
+    if unixCfg.Mode != "" {
+        var mode uint64
+        mode, err = strconv.ParseUint(unixCfg.Mode, 8, 32)
+        if err != nil {
+            err = fmt.Errorf("invalid socket mode: %s", unixCfg.Mode)
+            return
+        }
+        if err = os.Chmod(path, os.FileMode(mode)); err != nil {
+            return
+        }
+    }
+    if unixCfg.Owner == "" && unixCfg.Group == "" {
+        return
+    }
+    uid, gid := -1, -1
+    if unixCfg.Owner != "" {
+        if uid, err = lookupID(unixCfg.Owner, false); err != nil {
+            return
+        }
+    }
+    if unixCfg.Group != "" {
+        if gid, err = lookupID(unixCfg.Group, true); err != nil {
+            return
+        }
+    }
+    err = os.Chown(path, uid, gid)
+    return
+}
+
+// Takes a user (or group) name, or a numeric ID.
+func lookupID(name string, group bool) (id int, err error) {
+    if id, err = strconv.Atoi(name); err == nil {
+        return
+    }
+    if group {
+        var g *user.Group
+        if g, err = user.LookupGroup(name); err != nil {
+            return
+        }
+        return strconv.Atoi(g.Gid)
+    }
+    var u *user.User
+    if u, err = user.Lookup(name); err != nil {
+        return
+    }
+    return strconv.Atoi(u.Uid)
+}
+
+func (l listener) serve(isActive func() bool) {
+    if l.websocket {
+        err := http.Serve(l.ln, websocket.Server{Handler: acceptWebSocket})
+        if isActive() {
+            errorhandling.Log(err, false)
+        }
+        return
+    }
+    for {
+        conn, err := l.ln.Accept()
+        if !isActive() {
+            return
+        }
+        if err != nil {
+            errorhandling.Log(err, false)
+            continue
+        }
+        go handleClient(conn)
+    }
+}
+
+// Blur messages travel as binary frames. Any path is accepted.
+func acceptWebSocket(ws *websocket.Conn) {
+    ws.PayloadType = websocket.BinaryFrame
+    handleClient(&wsConn{
+        Conn: ws,
+        remote: wsAddr(ws.Request().RemoteAddr),
+    })
+}
+
+// A WebSocket connection only knows the origin the client claimed, so we keep
+// the address it actually connected from.
+type wsConn struct {
+    *websocket.Conn
+    remote net.Addr
+}
+
+func (conn *wsConn) RemoteAddr() net.Addr {
+    return conn.remote
+}
+
+type wsAddr string
+
+func (addr wsAddr) Network() string {
+    return "websocket"
+}
+
+func (addr wsAddr) String() string {
+    return string(addr)
+}
+
+// Clients can't check a self-signed certificate against anything but the
+// fingerprint they pinned, so it is printed for the admin to hand out.
+func loadTLS() (tlsConfig *tls.Config, err error) {
+    certPath, err := cfg.Path("server.crt")
+    if err != nil {
+        return
+    }
+    keyPath, err := cfg.Path("server.tls.key")
+    if err != nil {
+        return
+    }
+    cert, err := secure.LoadCertificate(certPath, keyPath)
+    if err != nil {
+        return
+    }
+    ui.Out(
+        "TLS certificate fingerprint: %s\n",
+        secure.Fingerprint(cert.Certificate[0]),
+    )
+    tlsConfig = &tls.Config{
+        Certificates: []tls.Certificate{cert},
+        MinVersion: tls.VersionTLS13,
+    }
+    return
+}
@@ -0,0 +1,221 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+	"github.com/therekrab/blur/cfg"
+	"github.com/therekrab/blur/errorhandling"
+	"github.com/therekrab/blur/message"
+)
+
+// What to do with a message for a client whose queue is already full.
+type overflowPolicy byte
+
+const (
+    // Drop the client. They'd have missed messages anyway, and with key
+    // exchange a missed REKEY leaves them out until they rejoin.
+    overflowDisconnect overflowPolicy = iota
+    overflowDropOldest
+    overflowDropNewest
+)
+
+func parseOverflowPolicy(name string) (policy overflowPolicy, err error) {
+    switch name {
+    case "", "disconnect":
+        policy = overflowDisconnect
+    case "drop-oldest":
+        policy = overflowDropOldest
+    case "drop-newest":
+        policy = overflowDropNewest
+    default:
+        err = fmt.Errorf("unknown overflow policy: %s", name)
+    }
+    return
+}
+
+type outboxSettings struct {
+    limit int
+    policy overflowPolicy
+    timeout time.Duration
+}
+
+var outboxCfg = outboxSettings{
+    limit: 256,
+    policy: overflowDisconnect,
+    timeout: 10 * time.Second,
+}
+
+func configureOutbox(serverCfg cfg.ServerCfg) (err error) {
+    if serverCfg.Queue > 0 {
+        outboxCfg.limit = int(serverCfg.Queue)
+    }
+    outboxCfg.policy, err = parseOverflowPolicy(serverCfg.Overflow)
+    if err != nil {
+        return
+    }
+    if serverCfg.WriteTimeout != "" {
+        outboxCfg.timeout, err = time.ParseDuration(serverCfg.WriteTimeout)
+    }
+    return
+}
+
+// outbox wraps a client connection so that writing to it only queues the
+// message. A goroutine of its own does the actual writing, so a client that
+// stops reading only ever holds up itself. Every Write has to be a whole
+// message, which is how message.SendTo writes. Broadcasts hand over their
+// frame through WriteFrame instead, so it's shared rather than copied.
+type outbox struct {
+    net.Conn
+    mu sync.Mutex
+    queue []*message.Frame
+    closing bool
+    // Set by Close: whatever isn't written by then is dropped.
+    flushBy time.Time
+    ready chan struct{}
+    // Closed once the writer is done and the connection closed.
+    done chan struct{}
+}
+
+func newOutbox(conn net.Conn) *outbox {
+    box := &outbox{
+        Conn: conn,
+        ready: make(chan struct{}, 1),
+        done: make(chan struct{}),
+    }
+    go box.run()
+    return box
+}
+
+func (box *outbox) Write(b []byte) (n int, err error) {
+    frame := message.FrameOf(b)
+    defer frame.Release()
+    if err = box.WriteFrame(frame); err != nil {
+        return
+    }
+    return len(b), nil
+}
+
+// Queues the frame, holding a reference to it until it's written or dropped.
+func (box *outbox) WriteFrame(frame *message.Frame) (err error) {
+    box.mu.Lock()
+    defer box.mu.Unlock()
+    if box.closing {
+        err = net.ErrClosed
+        return
+    }
+    if len(box.queue) >= outboxCfg.limit {
+        switch outboxCfg.policy {
+        case overflowDropNewest:
+            return
+        case overflowDropOldest:
+            box.queue[0].Release()
+            box.queue = box.queue[1:]
+        default:
+            err = fmt.Errorf("%s is not keeping up", box.RemoteAddr())
+            box.closing = true
+            box.drop()
+            box.Conn.Close()
+            box.wake()
+            return
+        }
+    }
+    frame.Retain()
+    box.queue = append(box.queue, frame)
+    box.wake()
+    return
+}
+
+// Releases everything still queued. The caller holds mu.
+func (box *outbox) drop() {
+    for _, frame := range box.queue {
+        frame.Release()
+    }
+    box.queue = nil
+}
+
+// The caller holds mu.
+func (box *outbox) wake() {
+    select {
+    case box.ready <- struct{}{}:
+    default:
+    }
+}
+
+// Flushes whatever is still queued (each write still has to finish in time)
+// and closes the connection.
+func (box *outbox) Close() (err error) {
+    box.mu.Lock()
+    if !box.closing {
+        box.closing = true
+        box.flushBy = time.Now().Add(outboxCfg.timeout)
+        box.wake()
+    }
+    box.mu.Unlock()
+    <- box.done
+    return
+}
+
+// Takes everything queued so far, to be written in one go, and when it has to
+// be written by. The caller releases the frames.
+func (box *outbox) next() (frames []*message.Frame, deadline time.Time) {
+    box.mu.Lock()
+    defer box.mu.Unlock()
+    frames = box.queue
+    box.queue = nil
+    deadline = time.Now().Add(outboxCfg.timeout)
+    if !box.flushBy.IsZero() && box.flushBy.Before(deadline) {
+        deadline = box.flushBy
+    }
+    return
+}
+
+// Writes the frames with as few syscalls as the connection allows (a plain
+// TCP connection takes them all in one writev). Anything that isn't a plain
+// connection still gets one Write per frame, so WebSocket frames and TLS
+// records never split a message.
+func (box *outbox) write(frames []*message.Frame, deadline time.Time) (err error) {
+    defer func() {
+        for _, frame := range frames {
+            frame.Release()
+        }
+    }()
+    buffers := make(net.Buffers, 0, len(frames))
+    for _, frame := range frames {
+        buffers = append(buffers, frame.Bytes())
+    }
+    box.Conn.SetWriteDeadline(deadline)
+    _, err = buffers.WriteTo(box.Conn)
+    return
+}
+
+func (box *outbox) run() {
+    defer close(box.done)
+    defer box.Conn.Close()
+    for range box.ready {
+        for {
+            frames, deadline := box.next()
+            if len(frames) == 0 {
+                break
+            }
+            if err := box.write(frames, deadline); err != nil {
+                errorhandling.Log(
+                    fmt.Errorf("could not write to %s: %s", box.RemoteAddr(), err),
+                    false,
+                )
+                box.mu.Lock()
+                box.closing = true
+                box.drop()
+                box.mu.Unlock()
+                return
+            }
+        }
+        box.mu.Lock()
+        closing := box.closing
+        box.mu.Unlock()
+        if closing {
+            return
+        }
+    }
+}
@@ -0,0 +1,275 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+	"github.com/therekrab/blur/message"
+	"github.com/therekrab/blur/ui"
+)
+
+// A client that stops reading: writes block until they're let through, the
+// deadline passes or the connection is closed.
+type stallConn struct {
+    mu sync.Mutex
+    deadline time.Time
+    written bytes.Buffer
+    // Gets a value whenever a write starts blocking.
+    writing chan struct{}
+    // Closed to let writes through.
+    flowing chan struct{}
+    closed chan struct{}
+    closeOnce sync.Once
+}
+
+func newStallConn() *stallConn {
+    return &stallConn{
+        writing: make(chan struct{}, 16),
+        flowing: make(chan struct{}),
+        closed: make(chan struct{}),
+    }
+}
+
+func (conn *stallConn) Write(b []byte) (n int, err error) {
+    conn.mu.Lock()
+    deadline := conn.deadline
+    conn.mu.Unlock()
+    var expired <-chan time.Time
+    if !deadline.IsZero() {
+        timer := time.NewTimer(time.Until(deadline))
+        defer timer.Stop()
+        expired = timer.C
+    }
+    conn.writing <- struct{}{}
+    select {
+    case <- conn.flowing:
+    case <- conn.closed:
+        return 0, net.ErrClosed
+    case <- expired:
+        return 0, os.ErrDeadlineExceeded
+    }
+    conn.mu.Lock()
+    defer conn.mu.Unlock()
+    return conn.written.Write(b)
+}
+
+func (conn *stallConn) Read(b []byte) (int, error) {
+    <- conn.closed
+    return 0, net.ErrClosed
+}
+
+func (conn *stallConn) Close() error {
+    conn.closeOnce.Do(func() { close(conn.closed) })
+    return nil
+}
+
+func (conn *stallConn) isClosed() bool {
+    select {
+    case <- conn.closed:
+        return true
+    default:
+        return false
+    }
+}
+
+func (conn *stallConn) output() []byte {
+    conn.mu.Lock()
+    defer conn.mu.Unlock()
+    return bytes.Clone(conn.written.Bytes())
+}
+
+func (conn *stallConn) LocalAddr() net.Addr {
+    return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4040}
+}
+
+func (conn *stallConn) RemoteAddr() net.Addr {
+    return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5050}
+}
+
+func (conn *stallConn) SetDeadline(t time.Time) error {
+    return conn.SetWriteDeadline(t)
+}
+
+func (conn *stallConn) SetReadDeadline(t time.Time) error {
+    return nil
+}
+
+func (conn *stallConn) SetWriteDeadline(t time.Time) error {
+    conn.mu.Lock()
+    defer conn.mu.Unlock()
+    conn.deadline = t
+    return nil
+}
+
+func withOutbox(t *testing.T, settings outboxSettings) {
+    t.Helper()
+    ui.SetLog("")
+    saved := outboxCfg
+    outboxCfg = settings
+    t.Cleanup(func() { outboxCfg = saved })
+}
+
+// Frames the test holds a reference to all along, so that when the outbox is
+// done with them, each should be back to exactly that one: anything more is a
+// leak, anything less a double release.
+func testFrames(n int) (frames []*message.Frame) {
+    for i := 0; i < n; i++ {
+        data := []byte{'a' + byte(i)}
+        msg := message.NewMessage(uint16(len(data)), message.CHT, data)
+        frames = append(frames, msg.Frame())
+    }
+    return
+}
+
+func checkRefs(t *testing.T, frames []*message.Frame) {
+    t.Helper()
+    for i, frame := range frames {
+        if refs := frame.Refs(); refs != 1 {
+            t.Errorf("frame %d has %d references", i, refs)
+        }
+        frame.Release()
+    }
+}
+
+func joined(frames ...*message.Frame) (b []byte) {
+    for _, frame := range frames {
+        b = append(b, frame.Bytes()...)
+    }
+    return
+}
+
+// Queues the first frame and waits for the writer to be stuck on it, so the
+// rest stay queued.
+func stall(t *testing.T, box *outbox, conn *stallConn, frame *message.Frame) {
+    t.Helper()
+    if err := box.WriteFrame(frame); err != nil {
+        t.Fatal(err)
+    }
+    <- conn.writing
+}
+
+func TestOutboxDisconnect(t *testing.T) {
+    withOutbox(t, outboxSettings{limit: 2, policy: overflowDisconnect, timeout: time.Minute})
+    conn := newStallConn()
+    box := newOutbox(conn)
+    frames := testFrames(4)
+    stall(t, box, conn, frames[0])
+    for _, frame := range frames[1:3] {
+        if err := box.WriteFrame(frame); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := box.WriteFrame(frames[3]); err == nil {
+        t.Fatal("overflowed without an error")
+    }
+    <- box.done
+    if !conn.isClosed() {
+        t.Fatal("connection left open")
+    }
+    if err := box.WriteFrame(frames[3]); err != net.ErrClosed {
+        t.Fatalf("queued after disconnecting: %v", err)
+    }
+    checkRefs(t, frames)
+}
+
+func TestOutboxDropOldest(t *testing.T) {
+    withOutbox(t, outboxSettings{limit: 2, policy: overflowDropOldest, timeout: time.Minute})
+    conn := newStallConn()
+    box := newOutbox(conn)
+    frames := testFrames(4)
+    stall(t, box, conn, frames[0])
+    for _, frame := range frames[1:] {
+        if err := box.WriteFrame(frame); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if refs := frames[1].Refs(); refs != 1 {
+        t.Fatalf("dropped frame has %d references", refs)
+    }
+    close(conn.flowing)
+    box.Close()
+    want := joined(frames[0], frames[2], frames[3])
+    if got := conn.output(); !bytes.Equal(got, want) {
+        t.Fatalf("wrote %v, want %v", got, want)
+    }
+    checkRefs(t, frames)
+}
+
+func TestOutboxDropNewest(t *testing.T) {
+    withOutbox(t, outboxSettings{limit: 2, policy: overflowDropNewest, timeout: time.Minute})
+    conn := newStallConn()
+    box := newOutbox(conn)
+    frames := testFrames(4)
+    stall(t, box, conn, frames[0])
+    for _, frame := range frames[1:] {
+        if err := box.WriteFrame(frame); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if refs := frames[3].Refs(); refs != 1 {
+        t.Fatalf("dropped frame has %d references", refs)
+    }
+    close(conn.flowing)
+    box.Close()
+    want := joined(frames[0], frames[1], frames[2])
+    if got := conn.output(); !bytes.Equal(got, want) {
+        t.Fatalf("wrote %v, want %v", got, want)
+    }
+    checkRefs(t, frames)
+}
+
+// A client that doesn't take a write in time is dropped, along with whatever
+// was queued for it.
+func TestOutboxWriteDeadline(t *testing.T) {
+    withOutbox(t, outboxSettings{limit: 8, policy: overflowDisconnect, timeout: 50 * time.Millisecond})
+    conn := newStallConn()
+    box := newOutbox(conn)
+    frames := testFrames(3)
+    stall(t, box, conn, frames[0])
+    for _, frame := range frames[1:] {
+        if err := box.WriteFrame(frame); err != nil {
+            t.Fatal(err)
+        }
+    }
+    select {
+    case <- box.done:
+    case <- time.After(5 * time.Second):
+        t.Fatal("still writing after the deadline")
+    }
+    if !conn.isClosed() {
+        t.Fatal("connection left open")
+    }
+    if len(conn.output()) != 0 {
+        t.Fatal("wrote past the deadline")
+    }
+    if err := box.WriteFrame(frames[0]); err != net.ErrClosed {
+        t.Fatalf("queued after the deadline: %v", err)
+    }
+    checkRefs(t, frames)
+}
+
+// Close flushes what's queued, but only until the deadline.
+func TestOutboxCloseGivesUp(t *testing.T) {
+    withOutbox(t, outboxSettings{limit: 8, policy: overflowDisconnect, timeout: 50 * time.Millisecond})
+    conn := newStallConn()
+    box := newOutbox(conn)
+    frames := testFrames(2)
+    stall(t, box, conn, frames[0])
+    if err := box.WriteFrame(frames[1]); err != nil {
+        t.Fatal(err)
+    }
+    closed := make(chan struct{})
+    go func() {
+        box.Close()
+        close(closed)
+    }()
+    select {
+    case <- closed:
+    case <- time.After(5 * time.Second):
+        t.Fatal("Close waited on a client that stopped reading")
+    }
+    checkRefs(t, frames)
+}
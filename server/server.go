@@ -1,6 +1,8 @@
 package server
 
 import (
+	"bytes"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
@@ -8,21 +10,118 @@ import (
 	"os/signal"
 	"sync"
 	"syscall"
+	"time"
+	"github.com/therekrab/blur/cfg"
 	"github.com/therekrab/blur/errorhandling"
 	"github.com/therekrab/blur/manager"
 	"github.com/therekrab/blur/message"
+	"github.com/therekrab/blur/secure"
 	"github.com/therekrab/blur/sender"
 	"github.com/therekrab/blur/ui"
 )
 
-func RunServer(port uint) (err error) {
-    addr := fmt.Sprintf("0.0.0.0:%d", port)
-    ln, err := net.Listen("tcp", addr)
+// How often expired sessions are looked for.
+const reapInterval = 30 * time.Second
+
+// How long a joiner waits for an owner to let them in.
+var knockTimeout = 2 * time.Minute
+
+func RunServer(serverCfg cfg.ServerCfg) (err error) {
+    keyPath, err := cfg.Path("server.key")
+    if err != nil {
+        errorhandling.Log(err, true)
+        return
+    }
+    signingKey, err := secure.LoadSigningKey(keyPath)
+    if err != nil {
+        errorhandling.Log(err, true)
+        return
+    }
+    manager.GetManager().SetSigningKey(signingKey)
+    err = configureOutbox(serverCfg)
+    if err != nil {
+        errorhandling.Log(err, true)
+        return
+    }
+    if serverCfg.MaxTTL != "" {
+        var maxTTL time.Duration
+        maxTTL, err = time.ParseDuration(serverCfg.MaxTTL)
+        if err != nil {
+            errorhandling.Log(err, true)
+            return
+        }
+        manager.GetManager().SetMaxTTL(maxTTL)
+    }
+    if serverCfg.KnockTimeout != "" {
+        knockTimeout, err = time.ParseDuration(serverCfg.KnockTimeout)
+        if err != nil {
+            errorhandling.Log(err, true)
+            return
+        }
+    }
+    policy, err := manager.ParseDuplicatePolicy(serverCfg.Duplicates)
+    if err != nil {
+        errorhandling.Log(err, true)
+        return
+    }
+    manager.GetManager().SetDuplicatePolicy(policy)
+    if serverCfg.Store != "" {
+        var store manager.SessionStore
+        store, err = manager.OpenFileStore(serverCfg.Store)
+        if err != nil {
+            errorhandling.Log(err, true)
+            return
+        }
+        var restored int
+        restored, err = manager.GetManager().SetStore(store)
+        if err != nil {
+            errorhandling.Log(err, true)
+            return
+        }
+        ui.Log("[ SERVER ] Restored %d sessions from %s\n", restored, serverCfg.Store)
+    }
+    // Sessions that outlive their members have to be cleaned up by somebody.
+    stopReaper := make(chan struct{})
+    defer close(stopReaper)
+    go manager.GetManager().RunReaper(reapInterval, stopReaper)
+    var tlsConfig *tls.Config
+    if serverCfg.TLS {
+        tlsConfig, err = loadTLS()
+        if err != nil {
+            errorhandling.Log(err, true)
+            return
+        }
+    }
+    specs := serverCfg.Listen
+    if len(specs) == 0 {
+        specs = []string{fmt.Sprintf("0.0.0.0:%d", serverCfg.Port)}
+    }
+    var listeners []listener
+    for _, spec := range specs {
+        var l listener
+        l, err = listen(spec, serverCfg.Unix, tlsConfig)
+        if err != nil {
+            errorhandling.Log(err, true)
+            return
+        }
+        listeners = append(listeners, l)
+        ui.Log("[ SERVER ] Listening on %s\n", spec)
+    }
+    if len(listeners) == 0 {
+        err = fmt.Errorf("nothing to listen on")
+        errorhandling.Log(err, true)
+        return
+    }
     // handle any SIGINTS to gracefully shut down
     sigs := make(chan os.Signal, 1)
     signal.Notify(sigs, syscall.SIGINT, syscall.SIGKILL)
     active := true
     activeMu := new(sync.Mutex)
+    isActive := func() bool {
+        activeMu.Lock()
+        defer activeMu.Unlock()
+        return active
+    }
     go func() {
         <- sigs
         ui.Out("\nExiting...\n")
@@ -30,60 +129,69 @@ func RunServer(port uint) (err error) {
         activeMu.Lock()
         active = false
         activeMu.Unlock()
-        ln.Close()
+        for _, l := range listeners {
+            l.ln.Close()
+        }
         errorhandling.Exit()
     }()
-    // Back to handling the actual input
-    if err != nil {
-        errorhandling.Log(err, true)
-        return
-    }
-    ui.Log("[ SERVER ] Running on port %d\n", port)
-    for {
-        var conn net.Conn
-        conn, err = ln.Accept()
-        activeMu.Lock()
-        if !active {
-            activeMu.Unlock()
-            return
-        }
-        activeMu.Unlock()
-        if err != nil {
-            errorhandling.Log(err, false)
-            continue
-        }
-        go handleClient(conn)
+    ui.Out(
+        "Server key fingerprint: %s\n",
+        secure.Fingerprint(manager.GetManager().ServerKey()),
+    )
+    var wg sync.WaitGroup
+    for _, l := range listeners {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            l.serve(isActive)
+        }()
     }
+    wg.Wait()
+    return
 }
 
-func handleClient(conn net.Conn) {
+func handleClient(rawConn net.Conn) {
+    // From here on, writes only queue, so nobody has to wait for this client.
+    conn := newOutbox(rawConn)
     defer conn.Close()
     connAddr := conn.RemoteAddr().String()
     ui.Log("[ %s ] Connected\n", connAddr)
     defer ui.Log("[ %s ] Disconnected\n", connAddr)
     // Read the first request
-    sessionID, err := firstRequest(conn)
+    sessionID, announced, err := firstRequest(conn)
     if err != nil {
         errorhandling.Log(err, false)
         return
     }
     ui.Log("[ %s ] Attached to Session %x\n", connAddr, sessionID)
+    // Hand over the key our events are signed with.
+    err = sender.SendServerKey(conn, manager.GetManager().ServerKey())
+    if err != nil {
+        errorhandling.Log(err, false)
+        return
+    }
     // Now we have to ask for identification.
-    ident, err := identRoutine(conn, sessionID)
+    ident, err := identRoutine(conn, sessionID, announced)
     if err != nil {
         errorhandling.Log(err, false)
         return
     }
     ui.Log("[ %s ] Identified as `%s`\n", connAddr, ident)
-    // Let the manager know who's connected!
-    manager.GetManager().AddClient(sessionID, ident, conn)
     // When we leave, let everybody know
     defer func() {
-        manager.GetManager().RemoveClient(sessionID, ident, conn)
-        leave(sessionID, ident)
+        // ...under whatever we're called by then.
+        current, err := manager.GetManager().GetIdent(sessionID, conn)
+        if err == nil {
+            ident = current
+        }
+        // Whoever was kicked or banned has been announced as such already.
+        if manager.GetManager().RemoveClient(sessionID, ident, conn) {
+            leave(sessionID, ident)
+        }
     }()
     // Now we have "authenticated" the server.
-    // Now the only MTYPEs that actually make sense are CHT(E) and IDENTR
+    // Now the only MTYPEs that actually make sense are CHT(E), IDENTR, the
+    // key exchange ones, OWN and MOD, and NAME
     // We may now begin receiving standard communications
     for {
         msg, err := message.ReadMessage(conn)
@@ -103,23 +211,62 @@ func handleClient(conn net.Conn) {
     }
 }
 
-func firstRequest(conn net.Conn) (sessionID uint16, err error) {
+// Besides the session, returns the ident the client said it would identify
+// as, if it did.
+func firstRequest(
+    conn net.Conn,
+) (sessionID uint16, announced []byte, err error) {
     msg, err := message.ReadMessage(conn)
     if err != nil {
         return
     }
+    if msg.MType() == message.SALTR {
+        // Only asking for the salt. The real JOIN? comes after.
+        if err = sendSalt(conn, msg.Data()); err != nil {
+            return
+        }
+        if msg, err = message.ReadMessage(conn); err != nil {
+            return
+        }
+    }
     switch msg.MType() {
     case message.JOINR:
         // Parse the message
         var sessionKeyHash []byte
-        sessionID, sessionKeyHash = message.ParseJoin(msg.Data())
+        sessionID, sessionKeyHash, announced, err = message.ParseJoin(msg.Data())
+        if err != nil {
+            return
+        }
         // Ask mgr if we can enter
-        ok, keyFailed := manager.GetManager().Verify(sessionID, sessionKeyHash) 
+        ok, reason := manager.GetManager().Verify(
+            sessionID,
+            sessionKeyHash,
+            conn,
+            announced,
+        )
+        if ok {
+            // ...and, if the session wants that, an owner.
+            ok, err = manager.GetManager().Knock(
+                sessionID,
+                announced,
+                knockTimeout,
+                func() error { return sender.SendWait(conn) },
+            )
+            reason = message.RejDenied
+        }
         if ok {
-            err = sender.SendAcc(conn)
+            var params []byte
+            params, err = manager.GetManager().Params(sessionID)
+            if err != nil {
+                return
+            }
+            err = sender.SendAcc(conn, params)
             ui.Log("[ %s ] Accepted to session\n", conn.RemoteAddr().String())
         } else {
-            if err = sender.SendReject(conn, keyFailed); err != nil {
+            if err != nil {
+                errorhandling.Log(err, false)
+            }
+            if err = sender.SendReject(conn, reason); err != nil {
                 errorhandling.Log(err, false)
             }
             err = fmt.Errorf("invalid login")
@@ -127,12 +274,26 @@ func firstRequest(conn net.Conn) (sessionID uint16, err error) {
         return
     case message.NEWR:
         // Build a new session, if possible
-        sessionID, err = manager.GetManager().NewSession(msg.Data())
+        var sessionKeyHash, salt, params, ownerSecret []byte
+        var ttl time.Duration
+        sessionKeyHash, salt, ttl, params, err = message.ParseNew(
+            msg.Data(),
+            secure.SaltSize,
+        )
+        if err != nil {
+            return
+        }
+        sessionID, ttl, ownerSecret, err = manager.GetManager().NewSession(
+            sessionKeyHash,
+            salt,
+            params,
+            ttl,
+        )
         if err != nil {
             // that sucks
             return
         } 
-        err = sender.SendNew(conn, sessionID)
+        err = sender.SendNew(conn, sessionID, ttl, ownerSecret)
         ui.Log("[ %s ] Created new session\n", conn.RemoteAddr().String())
         return
     }
@@ -144,6 +305,25 @@ func firstRequest(conn net.Conn) (sessionID uint16, err error) {
     return
 }
 
+// Hands out the salt of the session asked for, or rejects the client if
+// there's no such session.
+func sendSalt(conn net.Conn, data []byte) (err error) {
+    sessionID, err := message.ParseSaltR(data)
+    if err != nil {
+        return
+    }
+    salt, err := manager.GetManager().Salt(sessionID)
+    if err != nil {
+        if err = sender.SendReject(conn, message.RejSession); err != nil {
+            errorhandling.Log(err, false)
+        }
+        err = fmt.Errorf("invalid login")
+        return
+    }
+    err = sender.SendSalt(conn, salt)
+    return
+}
+
 func handleMessage(
     conn net.Conn,
     msg message.Message,
@@ -151,15 +331,15 @@ func handleMessage(
 ) (err error) {
     switch msg.MType() {
     case message.IDENTR:
-        // Ask the manager for a list of all idents
-        var idents [][]byte
-        idents, err = manager.GetManager().Identify(sessionID)
+        // Ask the manager for a list of all idents, and who the owners are
+        var idents, owners [][]byte
+        idents, owners, err = manager.GetManager().Identify(sessionID)
         if err != nil {
             return
         }
         // Send the message to the client
-        sender.SendIdent(conn, idents)
-    case message.CHT, message.CHTE:
+        sender.SendRoster(conn, idents, owners)
+    case message.CHT, message.CHTE, message.KEYR, message.KEY, message.REKEY:
         // broadcast the message to the entire session
         var ident []byte
         ident, err = manager.GetManager().GetIdent(sessionID, conn)
@@ -167,13 +347,53 @@ func handleMessage(
             errorhandling.Log(err, false)
             return
         }
-        alteredMsg := msg.PrependSource(ident)
+        var alteredMsg message.Message
+        alteredMsg, err = msg.PrependSource(ident)
+        if err != nil {
+            return refuse(conn, err)
+        }
         manager.GetManager().Broadcast(sessionID, alteredMsg)
+    case message.OWN:
+        err = manager.GetManager().Claim(sessionID, conn, msg.Data())
+        if err != nil {
+            return refuse(conn, err)
+        }
+    case message.NAME:
+        err = manager.GetManager().Rename(sessionID, conn, msg.Data())
+        if err != nil {
+            return refuse(conn, err)
+        }
+        ui.Log(
+            "[ %s ] Renamed to `%s`\n",
+            conn.RemoteAddr().String(),
+            msg.Data(),
+        )
+    case message.MOD:
+        var action message.ModAction
+        var arg []byte
+        action, arg, err = message.ParseMod(msg.Data())
+        if err == nil {
+            err = manager.GetManager().Moderate(sessionID, conn, action, arg)
+        }
+        if err != nil {
+            return refuse(conn, err)
+        }
     }
     return
 }
 
-func identRoutine(conn net.Conn, sessionID uint16) (ident []byte, err error) {
+// Tells the client why its request was refused. That's the end of it, unless
+// the client can't be told.
+func refuse(conn net.Conn, reason error) (err error) {
+    ui.Log("[ %s ] Refused: %s\n", conn.RemoteAddr().String(), reason)
+    return sender.SendErr(conn, reason.Error())
+}
+
+func identRoutine(
+    conn net.Conn,
+    sessionID uint16,
+    announced []byte,
+) (ident []byte, err error) {
     if err = sender.SendIdentR(conn); err != nil {
         errorhandling.Log(err, false)
         return
@@ -193,34 +413,35 @@ func identRoutine(conn net.Conn, sessionID uint16) (ident []byte, err error) {
         errorhandling.Log(err, false)
         return
     }
-    ident = idents[0]
-    // Tell everybody there's a new friend.
-    err = introduce(sessionID, ident)
-    if err != nil {
+    asked := idents[0]
+    if len(announced) > 0 && !bytes.Equal(asked, announced) {
+        // Owners let in whoever knocked, not somebody else.
+        err = fmt.Errorf("knocked as `%s`, identified as `%s`", announced, asked)
         errorhandling.Log(err, false)
         return
     }
-    return
-}
-
-func introduce(sessionID uint16, ident []byte) (err error) {
-    greeting := fmt.Sprintf("user '%s' has entered the session", ident)
-    msg, err := message.NewServerChat([]byte("server"), []byte(greeting))
+    // Let the manager know who's connected! It tells everybody there's a new
+    // friend.
+    ident, err = manager.GetManager().AddClient(sessionID, asked, conn)
     if err != nil {
-        return err
+        errorhandling.Log(err, false)
+        if sendErr := sender.SendErr(conn, err.Error()); sendErr != nil {
+            errorhandling.Log(sendErr, false)
+        }
+        return
+    }
+    if !bytes.Equal(ident, asked) {
+        // We're in the session now, so this is no reason to stop: if the
+        // client is gone, the next read tells us anyway.
+        if sendErr := sender.SendName(conn, ident); sendErr != nil {
+            errorhandling.Log(sendErr, false)
+        }
     }
-    manager.GetManager().Broadcast(sessionID, msg)
     return
 }
 
 func leave(sessionID uint16, ident []byte) {
-    farewell := fmt.Sprintf("user '%s' has exited the session", ident)
-    msg, err := message.NewServerChat([]byte("server"), []byte(farewell))
-    if err != nil {
-        errorhandling.Log(err, false)
-        // I would do a sendError, but this is the function for when the user
-        // has LEFT, so I can't send anything.
-        return
-    } 
-    manager.GetManager().Broadcast(sessionID, msg)
+    // If that was the last member, the session is gone and there's nobody
+    // left to tell, so there's no error worth reporting.
+    manager.GetManager().BroadcastEvent(sessionID, message.EvtLeave, ident)
 }
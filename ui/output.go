@@ -0,0 +1,128 @@
+package ui
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rivo/tview"
+)
+
+// How many entries are kept. Past that, the oldest quarter is let go of (and
+// leaves the screen), so that trimming doesn't redraw on every line.
+const maxEntries = 1000
+
+// One piece of output, already escaped and styled. Burning entries also keep
+// what they show until they burn, and when that is.
+type entry struct {
+    text string
+    prefix string
+    burning string
+    deadline time.Time
+}
+
+// The caller holds ui.mu.
+func write(text string) {
+    appendEntry(&entry{text: text})
+}
+
+// The caller holds ui.mu.
+func appendEntry(e *entry) {
+    ui.entries = append(ui.entries, e)
+    if len(ui.entries) <= maxEntries {
+        fmt.Fprint(ui.output, e.text)
+        return
+    }
+    ui.entries = slices.Clone(ui.entries[len(ui.entries) - maxEntries * 3 / 4:])
+    redraw()
+}
+
+// Draws every entry again, after one of them changed. The caller holds ui.mu.
+func redraw() {
+    var text strings.Builder
+    for _, e := range ui.entries {
+        text.WriteString(e.text)
+    }
+    ui.output.SetText(text.String())
+}
+
+// The caller holds ui.mu.
+func clearOutput() {
+    for _, e := range ui.burns {
+        e.burning = ""
+    }
+    ui.burns = nil
+    ui.entries = nil
+    ui.output.Clear()
+}
+
+// Shows the countdown, or once the deadline has passed, only the prefix and a
+// placeholder. Reports whether the entry is still burning.
+func (e *entry) render(now time.Time) (burning bool) {
+    left := e.deadline.Sub(now)
+    if left <= 0 {
+        e.burning = ""
+        e.text = fmt.Sprintf(
+            "%s[%s][burned][-]\n",
+            tview.Escape(e.prefix),
+            theme().altText,
+        )
+        return false
+    }
+    e.text = fmt.Sprintf(
+        "%s%s [%s](burns in %s)[-]\n",
+        tview.Escape(e.prefix),
+        tview.Escape(e.burning),
+        theme().altText,
+        left.Round(time.Second),
+    )
+    return true
+}
+
+// OutBurn shows prefix followed by text, with a countdown, for ttl. After that
+// only prefix and a placeholder are left. Burned text never goes anywhere
+// but the screen.
+func OutBurn(prefix string, text string, ttl time.Duration) {
+    if quiet || ui == nil || !ui.active {
+        return
+    }
+    ui.mu.Lock()
+    defer ui.mu.Unlock()
+    now := time.Now()
+    e := &entry{prefix: prefix, burning: text, deadline: now.Add(ttl)}
+    e.render(now)
+    appendEntry(e)
+    ui.burns = append(ui.burns, e)
+    if !ui.burnTicking {
+        ui.burnTicking = true
+        go burnLoop()
+    }
+}
+
+// Counts every burning entry down once a second, for as long as there are
+// any, and lets go of each once it has burned.
+func burnLoop() {
+    ticker := time.NewTicker(time.Second)
+    defer ticker.Stop()
+    for now := range ticker.C {
+        ui.mu.Lock()
+        burning := ui.burns[:0]
+        for _, e := range ui.burns {
+            if e.render(now) {
+                burning = append(burning, e)
+            }
+        }
+        clear(ui.burns[len(burning):])
+        ui.burns = burning
+        redraw()
+        done := len(ui.burns) == 0
+        if done {
+            ui.burnTicking = false
+        }
+        ui.mu.Unlock()
+        if done {
+            return
+        }
+    }
+}
@@ -0,0 +1,62 @@
+package ui
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+)
+
+var (
+    panicEnabled bool
+    panicKey tcell.Key
+    panicHooks []func()
+)
+
+// SetPanicKey picks the key that blanks the screen and drops everything, by
+// its tcell name ("Ctrl-Q", "F12", ...). An empty name disables it.
+func SetPanicKey(name string) (err error) {
+    panicEnabled = false
+    if name == "" {
+        return
+    }
+    for key, keyName := range tcell.KeyNames {
+        if strings.EqualFold(keyName, name) {
+            panicKey = key
+            panicEnabled = true
+            return
+        }
+    }
+    err = fmt.Errorf("unknown panic key: %s", name)
+    return
+}
+
+// OnPanic registers hook to run when the panic key is pressed. Hooks run in
+// the background, the last one registered first.
+func OnPanic(hook func()) {
+    panicHooks = append(panicHooks, hook)
+}
+
+func isPanicKey(event *tcell.EventKey) bool {
+    return panicEnabled && event.Key() == panicKey
+}
+
+// Runs in the event loop. Everything on screen is thrown away first, then the
+// whole layout is swapped for an empty box, so there's nothing left to redraw.
+func panicNow() {
+    ui.mu.Lock()
+    ui.panicked = true
+    clearOutput()
+    ui.errorReport.Clear()
+    ui.input.SetText("")
+    ui.input.SetLabel("")
+    ui.mu.Unlock()
+    ui.app.SetRoot(tview.NewBox(), true)
+    ui.app.Sync()
+    go func() {
+        for i := len(panicHooks) - 1; i >= 0; i-- {
+            panicHooks[i]()
+        }
+    }()
+}
@@ -20,7 +20,18 @@ type userInterface struct {
     input *tview.InputField
     output *tview.TextView
     errorReport *tview.TextView
+    // Everything shown in output lately, so that lines can change after
+    // they're written, and the ones still burning (see burnLoop).
+    entries []*entry
+    burns []*entry
+    burnTicking bool
     inputChan chan string
+    // Whether the session is locked, and what to ask for then (see Lock).
+    locked bool
+    lockPrompt string
+    // Set once the panic key is pressed. Only Esc (or the panic key again)
+    // does anything after that, and it quits.
+    panicked bool
 }
 
 var ui *userInterface
@@ -54,6 +65,16 @@ func Init() {
             if event.Key() == tcell.KeyCtrlC {
                 return nil
             }
+            if ui.panicked {
+                if event.Key() == tcell.KeyEsc || isPanicKey(event) {
+                    quit()
+                }
+                return nil
+            }
+            if isPanicKey(event) {
+                panicNow()
+                return nil
+            }
             return event
         })
     // Output: TextView
@@ -71,9 +92,7 @@ func Init() {
     ui.input = tview.NewInputField().
         SetDoneFunc(func(key tcell.Key) {
             if key == tcell.KeyEsc {
-                ui.app.Stop()
-                ui.inputChan <- ""
-                ui.active = false
+                quit()
             }
             if key == tcell.KeyEnter {
                 ui.inputChan <- ui.input.GetText()
@@ -104,6 +123,12 @@ func Init() {
     ui.active = true
 }
 
+func quit() {
+    ui.app.Stop()
+    ui.inputChan <- ""
+    ui.active = false
+}
+
 func Run(done chan error) {
     err := runUI()
     done <- err
@@ -136,7 +161,7 @@ func Out(format string, a... any) {
     defer ui.mu.Unlock()
     original := fmt.Sprintf(format, a...)
     safe := tview.Escape(original)
-    fmt.Fprintf(ui.output, "%s", safe)
+    write(safe)
 }
 
 func OutBold(format string, a... any) {
@@ -151,7 +176,24 @@ func OutBold(format string, a... any) {
     defer ui.mu.Unlock()
     original := fmt.Sprintf(format, a...)
     safe := tview.Escape(original)
-    fmt.Fprintf(ui.output, "[::b]%s[::-]", safe)
+    write(fmt.Sprintf("[::b]%s[::-]", safe))
+}
+
+// Like Out, but in the error color, for things the user shouldn't take at
+// face value.
+func OutWarn(format string, a... any) {
+    if quiet {
+        return
+    }
+    if ui == nil || !ui.active {
+        fmt.Printf(format, a...)
+        return
+    }
+    ui.mu.Lock()
+    defer ui.mu.Unlock()
+    original := fmt.Sprintf(format, a...)
+    safe := tview.Escape(original)
+    write(fmt.Sprintf("[%s]%s[-]", theme().error, safe))
 }
 
 func Err(format string, a... any) {
@@ -200,6 +242,71 @@ func ReadSecureInput(prompt string) (str string, err error) {
     return
 }
 
+// Like ReadSecureInput, but shows meter(text) next to the prompt as the user
+// types, without ever showing the text itself.
+func ReadSecureInputMeter(
+    prompt string,
+    meter func(string) string,
+) (str string, err error) {
+    if ui == nil || !ui.active {
+        err = fmt.Errorf("UI not active")
+        return
+    }
+    ui.input.SetChangedFunc(func(text string) {
+        if text == "" {
+            ui.input.SetLabel(prompt + " >> ")
+            return
+        }
+        ui.input.SetLabel(prompt + " (" + meter(text) + ") >> ")
+    })
+    ui.input.SetMaskCharacter('*')
+    str, err = ReadInput(prompt)
+    ui.input.SetMaskCharacter(0)
+    ui.input.SetChangedFunc(nil)
+    return
+}
+
+// Lock clears everything shown so far and masks whatever is being typed, for
+// when the session locks while ReadInput is waiting.
+func Lock(prompt string) {
+    if ui == nil || !ui.active {
+        return
+    }
+    ui.mu.Lock()
+    clearOutput()
+    ui.locked = true
+    ui.lockPrompt = prompt
+    ui.mu.Unlock()
+    // The input field is only safe to touch from the event loop. Nothing here
+    // waits for it, since whatever the loop is doing may be waiting on us.
+    go ui.app.QueueUpdateDraw(applyLock)
+}
+
+func Unlock() {
+    if ui == nil || !ui.active {
+        return
+    }
+    ui.mu.Lock()
+    ui.locked = false
+    ui.mu.Unlock()
+    go ui.app.QueueUpdateDraw(applyLock)
+}
+
+// Runs in the event loop. Updates queued by Lock and Unlock may run in any
+// order, so each one applies whatever was asked for last.
+func applyLock() {
+    ui.mu.Lock()
+    locked, prompt := ui.locked, ui.lockPrompt
+    ui.mu.Unlock()
+    if !locked {
+        ui.input.SetMaskCharacter(0)
+        return
+    }
+    ui.input.SetText("")
+    ui.input.SetMaskCharacter('*')
+    ui.input.SetLabel(prompt + " >> ")
+}
+
 func Cleanup() {
     if ui != nil && ui.active {
         ui.app.Stop()